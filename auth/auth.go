@@ -0,0 +1,60 @@
+// Package auth authenticates the callers of the registry server, so only the authorized
+// workloads could register themselves.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredential is returned by the authenticators if the request doesn't carry the kind of
+// credential they understand, then the other authenticators could try it.
+var ErrNoCredential = errors.New("no credential found in request")
+
+// Authenticator authenticates the requests to the registry server.
+type Authenticator interface {
+	// Authenticate returns the name of the caller, or an error if the request is not authenticated.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator.
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// Union tries the authenticators in order, the request is authenticated if any of them succeeds.
+func Union(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		var errs []string
+		for _, a := range authenticators {
+			user, err := a.Authenticate(r)
+			if err == nil {
+				return user, nil
+			}
+			if err != ErrNoCredential {
+				errs = append(errs, err.Error())
+			}
+		}
+
+		if len(errs) == 0 {
+			return "", ErrNoCredential
+		}
+
+		return "", fmt.Errorf("%s", strings.Join(errs, "; "))
+	})
+}
+
+// BearerToken returns the token in the "Authorization: Bearer <token>" header of request,
+// empty if there is no such header.
+func BearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+func TestTokens(t *testing.T) {
+	tokens := Tokens{"secret-token": "team-a"}
+
+	r := httptest.NewRequest(http.MethodPost, "/register", nil)
+	if _, err := tokens.Authenticate(r); err != ErrNoCredential {
+		t.Fatalf("authenticate request without token returns %v, should be %v", err, ErrNoCredential)
+	}
+
+	r.Header.Set("Authorization", "Bearer wrong-token")
+	if _, err := tokens.Authenticate(r); err == nil {
+		t.Fatalf("authenticate request with wrong token should fail")
+	}
+
+	r.Header.Set("Authorization", "Bearer secret-token")
+	user, err := tokens.Authenticate(r)
+	if err != nil {
+		t.Fatalf("authenticate request with token failed: %v", err)
+	}
+
+	if user != "team-a" {
+		t.Fatalf("the user of token is %q, should be team-a", user)
+	}
+}
+
+func TestLoadTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kr")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.csv")
+	if err := ioutil.WriteFile(path, []byte("# token,user\ntoken-a,team-a\n\ntoken-b,team-b\n"), 0600); err != nil {
+		t.Fatalf("write token file failed: %v", err)
+	}
+
+	tokens, err := LoadTokenFile(path)
+	if err != nil {
+		t.Fatalf("load token file failed: %v", err)
+	}
+
+	if len(tokens) != 2 || tokens["token-a"] != "team-a" || tokens["token-b"] != "team-b" {
+		t.Fatalf("the loaded tokens are %v, should be token-a and token-b", tokens)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token-a\n"), 0600); err != nil {
+		t.Fatalf("write token file failed: %v", err)
+	}
+
+	if _, err := LoadTokenFile(path); err == nil {
+		t.Fatalf("load invalid token file should fail")
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	keys := HMAC{"team-a": []byte("secret")}
+	body := "address=localhost&port=8080&endpoint=%2Fwebhook"
+
+	r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	Sign(r, []byte(body), "team-a", []byte("secret"))
+
+	user, err := keys.Authenticate(r)
+	if err != nil {
+		t.Fatalf("authenticate signed request failed: %v", err)
+	}
+
+	if user != "team-a" {
+		t.Fatalf("the user of signed request is %q, should be team-a", user)
+	}
+
+	// The body is still readable by the handlers.
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil || string(b) != body {
+		t.Fatalf("the body after authentication is %q, should be %q", string(b), body)
+	}
+
+	// The body is tampered.
+	r = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader("address=evil.com&port=8080&endpoint=%2Fwebhook"))
+	Sign(r, []byte(body), "team-a", []byte("secret"))
+	if _, err := keys.Authenticate(r); err == nil {
+		t.Fatalf("authenticate tampered request should fail")
+	}
+
+	// The request is signed with the wrong secret.
+	r = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	Sign(r, []byte(body), "team-a", []byte("wrong"))
+	if _, err := keys.Authenticate(r); err == nil {
+		t.Fatalf("authenticate request signed with wrong secret should fail")
+	}
+
+	// The signature is out of date.
+	defer func(skew time.Duration) {
+		maxSkew = skew
+	}(maxSkew)
+	maxSkew = -time.Second
+
+	r = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	Sign(r, []byte(body), "team-a", []byte("secret"))
+	if _, err := keys.Authenticate(r); err == nil {
+		t.Fatalf("authenticate request with out of date signature should fail")
+	}
+}
+
+func TestUnion(t *testing.T) {
+	authenticator := Union(Tokens{"secret-token": "team-a"}, HMAC{"team-b": []byte("secret")})
+
+	r := httptest.NewRequest(http.MethodPost, "/register", nil)
+	if _, err := authenticator.Authenticate(r); err != ErrNoCredential {
+		t.Fatalf("authenticate request without credential returns %v, should be %v", err, ErrNoCredential)
+	}
+
+	r.Header.Set("Authorization", "Bearer secret-token")
+	if user, err := authenticator.Authenticate(r); err != nil || user != "team-a" {
+		t.Fatalf("authenticate request with token returns %q, %v, should be team-a", user, err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/register", nil)
+	Sign(r, nil, "team-b", []byte("secret"))
+	if user, err := authenticator.Authenticate(r); err != nil || user != "team-b" {
+		t.Fatalf("authenticate signed request returns %q, %v, should be team-b", user, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{User: "team-a", Names: []string{"payments", "payments-*"}, Addresses: []string{"10.0.1.*:*"}},
+			{User: "system:serviceaccount:default:*", Names: []string{"example-client"}},
+		},
+	}
+
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("validate policy failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		user    string
+		service *types.Service
+		allowed bool
+	}{
+		{"team-a", &types.Service{Name: "payments", Address: "10.0.1.2", Port: 8080}, true},
+		{"team-a", &types.Service{Name: "payments-v2", Address: "10.0.1.3", Port: 8080}, true},
+		{"team-a", &types.Service{Name: "payments", Address: "10.0.2.2", Port: 8080}, false},
+		{"team-a", &types.Service{Name: "example-client", Address: "10.0.1.2", Port: 8080}, false},
+		{"team-b", &types.Service{Name: "payments", Address: "10.0.1.2", Port: 8080}, false},
+		{"system:serviceaccount:default:example-client", &types.Service{Name: "example-client", Address: "localhost", Port: 10813}, true},
+		{"system:serviceaccount:kube-system:example-client", &types.Service{Name: "example-client", Address: "localhost", Port: 10813}, false},
+	} {
+		err := policy.Authorize(c.user, c.service)
+		if allowed := err == nil; allowed != c.allowed {
+			t.Fatalf("%s owning %v is allowed: %v, should be %v", c.user, c.service, allowed, c.allowed)
+		}
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kr")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(`{"rules": [{"user": "team-a", "names": ["payments"]}]}`), 0600); err != nil {
+		t.Fatalf("write policy file failed: %v", err)
+	}
+
+	policy, err := LoadPolicyFile(path)
+	if err != nil {
+		t.Fatalf("load policy file failed: %v", err)
+	}
+
+	if err := policy.Authorize("team-a", &types.Service{Name: "payments"}); err != nil {
+		t.Fatalf("authorize team-a to own payments failed: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"rules": [{"user": "team-[a", "names": ["payments"]}]}`), 0600); err != nil {
+		t.Fatalf("write policy file failed: %v", err)
+	}
+
+	if _, err := LoadPolicyFile(path); err == nil {
+		t.Fatalf("load policy file with malformed pattern should fail")
+	}
+}
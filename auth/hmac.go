@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hmacScheme = "HMAC-SHA256"
+
+	// The max size of the body of the signed requests.
+	maxBodySize = 1 << 20
+)
+
+// The max difference between the timestamp of the signed request and the clock of server, the
+// signed requests could be replayed in the window.
+var maxSkew = 5 * time.Minute
+
+// HMAC authenticates the requests signed by Sign, the keys are the key IDs and the values are
+// their secrets. The name of caller is the key ID.
+type HMAC map[string][]byte
+
+func (h HMAC) Authenticate(r *http.Request) (string, error) {
+	scheme, params := splitAuthorization(r.Header.Get("Authorization"))
+	if scheme != hmacScheme {
+		return "", ErrNoCredential
+	}
+
+	keyID, timestamp, signature := params["Credential"], params["Timestamp"], params["Signature"]
+	secret, ok := h[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q of signature", keyID)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q of signature", timestamp)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return "", fmt.Errorf("the timestamp of signature is out of date")
+	}
+
+	// Read the body to verify it, then put it back for the handlers.
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return "", err
+		}
+		if len(body) > maxBodySize {
+			return "", fmt.Errorf("the body of signed request is too large")
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature")
+	}
+	if !hmac.Equal(expected, sign(r, timestamp, body, secret)) {
+		return "", fmt.Errorf("invalid signature")
+	}
+
+	return keyID, nil
+}
+
+// Sign signs the request with the key, the body must be the same as the body of request. The
+// method, URI, body and the current time are signed.
+func Sign(r *http.Request, body []byte, keyID string, secret []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := hex.EncodeToString(sign(r, timestamp, body, secret))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Timestamp=%s, Signature=%s", hmacScheme, keyID, timestamp, signature))
+}
+
+func sign(r *http.Request, timestamp string, body []byte, secret []byte) []byte {
+	digest := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), timestamp, digest)
+	return mac.Sum(nil)
+}
+
+// splitAuthorization splits the "Authorization: <scheme> k1=v1, k2=v2" header.
+func splitAuthorization(header string) (string, map[string]string) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return parts[0], nil
+	}
+
+	params := make(map[string]string)
+	for _, kv := range strings.Split(parts[1], ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			params[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+
+	return parts[0], params
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// Authorizer decides whether the user could register or deregister the service.
+type Authorizer interface {
+	// Authorize returns an error if the user is not allowed to own the service.
+	Authorize(user string, service *types.Service) error
+}
+
+// Policy binds the services to their owners, a service could only be registered or deregistered
+// by the users of the rules matching it. Nothing is allowed if there is no rule.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule allows the users to own the services. All the fields are glob patterns of path.Match,
+// such as "team-a", "payments-*" or "10.0.1.*:*".
+type Rule struct {
+	// The name of users, such as "system:serviceaccount:default:*".
+	User string `json:"user"`
+	// The names of services the users could own, empty means none.
+	Names []string `json:"names"`
+	// The "address:port" of services the users could own, empty means any.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// LoadPolicyFile loads the policy from the JSON file.
+func LoadPolicyFile(file string) (*Policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(b, policy); err != nil {
+		return nil, fmt.Errorf("parse policy file %s failed: %v", file, err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", file, err)
+	}
+
+	return policy, nil
+}
+
+// Validate checks the patterns of policy, the malformed patterns never match anything.
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		patterns := append([]string{rule.User}, rule.Names...)
+		patterns = append(patterns, rule.Addresses...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q in rule %d: %v", pattern, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) Authorize(user string, service *types.Service) error {
+	address := net.JoinHostPort(service.Address, strconv.Itoa(service.Port))
+	for _, rule := range p.Rules {
+		if match([]string{rule.User}, user) && match(rule.Names, service.Name) &&
+			(len(rule.Addresses) == 0 || match(rule.Addresses, address)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("user %q is not allowed to own service %q at %s", user, service.Name, address)
+}
+
+// match checks whether the value matches any of the patterns.
+func match(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tokens authenticates the requests with static bearer tokens, the keys are the tokens and
+// the values are the names of their users.
+type Tokens map[string]string
+
+func (t Tokens) Authenticate(r *http.Request) (string, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return "", ErrNoCredential
+	}
+
+	// Compare all the tokens in constant time, so the tokens could not be guessed by timing.
+	user := ""
+	for known, name := range t {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			user = name
+		}
+	}
+
+	if user == "" {
+		return "", fmt.Errorf("invalid bearer token")
+	}
+
+	return user, nil
+}
+
+// LoadTokenFile loads the static tokens from the file, each line of it is "token,user". The empty
+// lines and the lines start with "#" are ignored.
+func LoadTokenFile(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(Tokens)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.Split(text, ",")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid token at line %d of %s, should be token,user", line, path)
+		}
+		tokens[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,56 @@
+// Package tokenreview authenticates the pods by their service account tokens with the
+// TokenReview API of Kubernetes.
+package tokenreview
+
+import (
+	"fmt"
+	"net/http"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authenticationclientv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+
+	"github.com/YaoZengzeng/kr/auth"
+)
+
+// Authenticator reviews the bearer tokens, the name of caller is the user of token, such as
+// "system:serviceaccount:<namespace>:<name>" for service accounts.
+type Authenticator struct {
+	client authenticationclientv1.TokenReviewInterface
+	// The token must be issued for one of the audiences, empty means the API server's.
+	audiences []string
+}
+
+func New(client authenticationclientv1.TokenReviewInterface, audiences ...string) *Authenticator {
+	return &Authenticator{
+		client:    client,
+		audiences: audiences,
+	}
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	token := auth.BearerToken(r)
+	if token == "" {
+		return "", auth.ErrNoCredential
+	}
+
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: a.audiences,
+		},
+	}
+
+	review, err := a.client.CreateContext(r.Context(), review)
+	if err != nil {
+		return "", fmt.Errorf("review token failed: %v", err)
+	}
+
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return "", fmt.Errorf("token is not authenticated: %s", review.Status.Error)
+		}
+		return "", fmt.Errorf("token is not authenticated")
+	}
+
+	return review.Status.User.Username, nil
+}
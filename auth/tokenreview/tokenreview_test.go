@@ -0,0 +1,48 @@
+package tokenreview
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/YaoZengzeng/kr/auth"
+)
+
+func TestAuthenticate(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		if review.Spec.Token == "pod-token" {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:default:example-client"
+		}
+		return true, review, nil
+	})
+
+	authenticator := New(clientset.AuthenticationV1().TokenReviews())
+
+	r := httptest.NewRequest(http.MethodPost, "/register", nil)
+	if _, err := authenticator.Authenticate(r); err != auth.ErrNoCredential {
+		t.Fatalf("authenticate request without token returns %v, should be %v", err, auth.ErrNoCredential)
+	}
+
+	r.Header.Set("Authorization", "Bearer other-token")
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatalf("authenticate request with unknown token should fail")
+	}
+
+	r.Header.Set("Authorization", "Bearer pod-token")
+	user, err := authenticator.Authenticate(r)
+	if err != nil {
+		t.Fatalf("authenticate request with pod token failed: %v", err)
+	}
+
+	if user != "system:serviceaccount:default:example-client" {
+		t.Fatalf("the user of pod token is %q, should be the service account", user)
+	}
+}
@@ -1,7 +1,9 @@
 package client
 
 import (
-	"crypto/md5"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,26 +11,72 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/YaoZengzeng/kr/auth"
+	"github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
 type Client struct {
-	c         *http.Client
+	c *http.Client
+	// Address of the registry server, such as "http://127.0.0.1:10812".
 	registry  string
 	heartbeat time.Duration
+	// tls is used to talk to the registry server over HTTPS, nil means the default.
+	tls *tls.Config
+	// The credential to authenticate the client, at most one of them is set.
+	token  string
+	keyID  string
+	secret []byte
 
 	mtx      sync.Mutex
-	services map[string]chan struct{}
+	services map[string]*heartbeat
+	closed   bool
+}
+
+// heartbeat tracks the goroutine which keeps registering a service.
+type heartbeat struct {
+	service *types.Service
+	// cancel stops the goroutine and aborts its in-flight request.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stop stops the heartbeat and waits for it to exit, so it won't register the service again.
+// It must be called without the lock of client held.
+func (hb *heartbeat) stop() {
+	hb.cancel()
+	<-hb.done
 }
 
 type Option func(*Client) error
 
+// WithRegistry sets the base URL of the registry server, such as "http://127.0.0.1:10812".
+//
+// Breaking change: it used to be the full URL of the legacy register endpoint, such as
+// "http://127.0.0.1:10812/register". The trailing "/register" of the legacy URL is stripped with
+// a warning, so the old configurations keep working, but the other paths are kept as the prefix
+// of the API, e.g. of a reverse proxy.
 func WithRegistry(registry string) Option {
 	return func(c *Client) error {
-		c.registry = registry
+		u, err := url.Parse(registry)
+		if err != nil {
+			return fmt.Errorf("invalid registry %q: %v", registry, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid registry %q: should be a base URL such as http://127.0.0.1:10812", registry)
+		}
+
+		if strings.HasSuffix(u.Path, legacyRegisterPath) {
+			log.Printf("registry %q is the URL of the legacy register endpoint, use its base URL instead\n", registry)
+			u.Path = strings.TrimSuffix(u.Path, legacyRegisterPath)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+
+		c.registry = u.String()
 		return nil
 	}
 }
@@ -40,9 +88,49 @@ func WithHeartbeat(heartbeat time.Duration) Option {
 	}
 }
 
+// WithTLSConfig sets the TLS config to talk to the registry server over HTTPS, such as the CA
+// of server and the certificate of client if the server verifies it.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) error {
+		c.tls = config
+		return nil
+	}
+}
+
+// WithToken authenticates the client with the bearer token, such as a static token or the
+// service account token of pod.
+func WithToken(token string) Option {
+	return func(c *Client) error {
+		c.token = token
+		return nil
+	}
+}
+
+// WithTokenFile authenticates the client with the bearer token in the file, such as
+// "/var/run/secrets/kubernetes.io/serviceaccount/token".
+func WithTokenFile(path string) Option {
+	return func(c *Client) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read token file failed: %v", err)
+		}
+		c.token = strings.TrimSpace(string(b))
+		return nil
+	}
+}
+
+// WithHMAC signs the requests with the key, the server verifies them with the same secret.
+func WithHMAC(keyID string, secret []byte) Option {
+	return func(c *Client) error {
+		c.keyID = keyID
+		c.secret = secret
+		return nil
+	}
+}
+
 func New(opts ...Option) (*Client, error) {
 	c := &Client{
-		services: make(map[string]chan struct{}),
+		services: make(map[string]*heartbeat),
 	}
 
 	for _, opt := range opts {
@@ -51,81 +139,283 @@ func New(opts ...Option) (*Client, error) {
 		}
 	}
 
+	if c.token != "" && c.keyID != "" {
+		return nil, fmt.Errorf("only one of token and HMAC key could be used")
+	}
+
 	c.c = &http.Client{
 		// Set timeout of http client to heartbeat period.
 		Timeout: c.heartbeat,
 	}
+	if c.tls != nil {
+		c.c.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.tls,
+		}
+	}
 
 	return c, nil
 }
 
-func (c *Client) Register(service *types.Service) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+// servicesPath is the path of the versioned JSON API of services on the registry server.
+const servicesPath = "/v1/services"
+
+// legacyRegisterPath is the path of the register endpoint kept for the old clients, which
+// WithRegistry used to be set to.
+const legacyRegisterPath = "/register"
+
+// The retries of the requests failed with retryable errors, the backoff doubles each time.
+var (
+	retries = 3
+	backoff = 100 * time.Millisecond
+)
+
+// send sends the service to the registry server with the method, POST registers it as JSON
+// and DELETE deregisters it by its key. The retryable errors are retried with backoff until ctx
+// is done.
+func (c *Client) send(ctx context.Context, method string, service *types.Service) error {
+	path, body := servicesPath, []byte(nil)
+	if method == http.MethodDelete {
+		path += "/" + service.Key()
+	} else {
+		var err error
+		if body, err = json.Marshal(service); err != nil {
+			return err
+		}
+	}
+
+	delay := backoff
+	for i := 0; ; i++ {
+		err := c.sendOnce(ctx, method, path, body)
+		if i == retries || !IsRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, method string, path string, body []byte) error {
+	req, err := http.NewRequest(method, c.registry+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req, body)
 
-	b, err := json.Marshal(service)
+	resp, err := c.c.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
-	key := fmt.Sprintf("%x", md5.Sum(b))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		err := errorOf(method, path, resp)
+		// The service has expired or been deregistered already.
+		if e, ok := err.(*types.Error); ok && method == http.MethodDelete && e.Code == types.CodeNotFound {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// errorOf returns the error replied by the server. It's *types.ValidationError if the service is
+// invalid, otherwise *types.Error if the server replies the JSON envelope.
+func errorOf(method string, path string, resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read body of http response failed: %v", err)
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		e := &types.Error{}
+		if err := json.Unmarshal(body, e); err == nil && e.Code != "" {
+			if e.Code == types.CodeInvalidService && len(e.Fields) != 0 {
+				return &types.ValidationError{Fields: e.Fields}
+			}
+			return e
+		}
+	}
+
+	return fmt.Errorf("the status code of %s %s is %d, body: %v", method, path, resp.StatusCode, string(body))
+}
+
+// IsRetryable checks whether the error is replied by the server and the same request may succeed later.
+func IsRetryable(err error) bool {
+	e, ok := err.(*types.Error)
+	return ok && e.Retryable
+}
+
+// authorize attaches the credential of client to the request with the body.
+func (c *Client) authorize(req *http.Request, body []byte) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.keyID != "":
+		auth.Sign(req, body, c.keyID, c.secret)
+	}
+}
+
+// Register keeps registering the service to the registry every heartbeat period until it's
+// deregistered. The service is validated first, an invalid service returns
+// *types.ValidationError. The heartbeats outlive ctx, it only bounds the call itself.
+func (c *Client) Register(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return fmt.Errorf("client is closed")
+	}
+
+	key := service.Key()
 
 	if _, ok := c.services[key]; ok {
 		// The service has registered, return.
 		return nil
 	}
 
-	stop := make(chan struct{})
+	hbCtx, cancel := context.WithCancel(context.Background())
+	hb := &heartbeat{
+		service: service,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
 	go func() {
+		defer close(hb.done)
+
 		ticker := time.NewTicker(c.heartbeat)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				resp, err := c.c.PostForm(c.registry, url.Values{
-					"address":  {service.Address},
-					"port":     {strconv.Itoa(service.Port)},
-					"endpoint": {service.Endpoint},
-				})
-				if err != nil {
-					log.Printf("register service to register failed: %v\n", err)
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode != http.StatusOK {
-					body, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						log.Printf("read body of http response failed: %v", err)
-					}
-					log.Printf("the status code of register is not 200, body: %v", string(body))
+				if err := c.send(hbCtx, http.MethodPost, service); err != nil && hbCtx.Err() == nil {
+					log.Printf("register service to registry failed: %v\n", err)
 				}
-			case <-stop:
+			case <-hbCtx.Done():
 				return
 			}
 		}
 	}()
 
-	c.services[key] = stop
+	c.services[key] = hb
 	return nil
 }
 
-func (c *Client) Deregister(service *types.Service) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
-	b, err := json.Marshal(service)
-	if err != nil {
-		return err
-	}
+// Deregister stops the heartbeat of the service and removes it from the registry
+// right away, so it won't get traffic until its TTL expires. It succeeds if the service has
+// expired in the registry already.
+func (c *Client) Deregister(ctx context.Context, service *types.Service) error {
+	key := service.Key()
 
-	key := fmt.Sprintf("%x", md5.Sum(b))
+	c.mtx.Lock()
+	hb, ok := c.services[key]
+	delete(c.services, key)
+	c.mtx.Unlock()
 
-	ch, ok := c.services[key]
 	if !ok {
 		// If the service dosn't exist, do nothing and return.
 		return nil
 	}
 
-	close(ch)
-	delete(c.services, key)
+	// Wait for the in-flight heartbeat, otherwise it may register the service again
+	// after deregisteration.
+	hb.stop()
+
+	return c.send(ctx, http.MethodDelete, service)
+}
+
+// Close stops the heartbeats of all the registered services and deregisters them from the
+// registry, the client can't register services after that. All the services are deregistered
+// even if some of them failed, ctx bounds all the deregistrations together.
+//
+// Breaking change: Close used to take no ctx, and could block forever on an unreachable registry.
+func (c *Client) Close(ctx context.Context) error {
+	c.mtx.Lock()
+	c.closed = true
+	services := c.services
+	c.services = make(map[string]*heartbeat)
+	c.mtx.Unlock()
+
+	var errs []string
+	for _, hb := range services {
+		hb.stop()
+
+		if err := c.send(ctx, http.MethodDelete, hb.service); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	c.c.CloseIdleConnections()
+
+	if len(errs) != 0 {
+		return fmt.Errorf("deregister services failed: %s", strings.Join(errs, "; "))
+	}
 
 	return nil
 }
+
+// ListServices gets the registered services from the registry server, all the options are passed
+// to the server as the query parameters.
+func (c *Client) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	options := registry.NewListOptions(opts...)
+
+	query := url.Values{}
+	if options.Name != "" {
+		query.Set("name", options.Name)
+	}
+	if options.ID != "" {
+		query.Set("id", options.ID)
+	}
+	if options.Address != "" {
+		query.Set("address", options.Address)
+	}
+	if options.Port != 0 {
+		query.Set("port", strconv.Itoa(options.Port))
+	}
+	if options.Endpoint != "" {
+		query.Set("endpoint", options.Endpoint)
+	}
+	if options.Selector != nil {
+		query.Set("selector", options.Selector.String())
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.registry+servicesPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req, nil)
+
+	resp, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorOf(http.MethodGet, servicesPath, resp)
+	}
+
+	var services []*types.Service
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
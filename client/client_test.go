@@ -1,40 +1,57 @@
 package client
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"net/url"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/YaoZengzeng/kr/auth"
+	"github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
 func TestClient(t *testing.T) {
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	var deregistered int32
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check parameters.
-		r.ParseForm()
-		_, ok := r.Form["address"]
-		if !ok {
-			http.Error(w, fmt.Sprintf("failed to parse address of service"), http.StatusBadRequest)
+		// The service is deregistered by its key without body.
+		if r.Method == http.MethodDelete {
+			if r.URL.Path != "/v1/services/"+service.Key() {
+				http.Error(w, fmt.Sprintf("unexpected path %s", r.URL.Path), http.StatusNotFound)
+				return
+			}
+			atomic.AddInt32(&deregistered, 1)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
-		paramPort, ok := r.Form["port"]
-		if !ok {
-			http.Error(w, fmt.Sprintf("failed to parse port of service"), http.StatusBadRequest)
+		if r.URL.Path != "/v1/services" {
+			http.Error(w, fmt.Sprintf("unexpected path %s", r.URL.Path), http.StatusNotFound)
 			return
 		}
-		_, err := strconv.Atoi(paramPort[0])
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to convert port number to int"), http.StatusBadRequest)
+
+		// Check the JSON service in body.
+		service := &types.Service{}
+		if err := json.NewDecoder(r.Body).Decode(service); err != nil {
+			http.Error(w, fmt.Sprintf("failed to decode service: %v", err), http.StatusBadRequest)
 			return
 		}
-
-		_, ok = r.Form["endpoint"]
-		if !ok {
-			http.Error(w, fmt.Sprintf("failed to parse endpoint of service"), http.StatusBadRequest)
+		if err := service.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}))
@@ -50,15 +67,9 @@ func TestClient(t *testing.T) {
 		t.Fatalf("create client failed: %v", err)
 	}
 
-	service := &types.Service{
-		Address:  "localhost",
-		Port:     8080,
-		Endpoint: "/webhook",
-	}
-
 	// Register same service multiple times to test idempotency.
 	for i := 0; i < 3; i++ {
-		if err = client.Register(service); err != nil {
+		if err = client.Register(context.Background(), service); err != nil {
 			t.Fatalf("register service failed: %v", err)
 		}
 	}
@@ -69,7 +80,7 @@ func TestClient(t *testing.T) {
 
 	// Deregister same service multiple times to test idempotency.
 	for i := 0; i < 3; i++ {
-		if err := client.Deregister(service); err != nil {
+		if err := client.Deregister(context.Background(), service); err != nil {
 			t.Fatalf("deregister service failed: %v", err)
 		}
 	}
@@ -77,4 +88,393 @@ func TestClient(t *testing.T) {
 	if len(client.services) != 0 {
 		t.Fatalf("the number of registered service is %d, should be 0 after deregisteration", len(client.services))
 	}
+
+	if n := atomic.LoadInt32(&deregistered); n != 1 {
+		t.Fatalf("the number of deregister requests is %d, should be 1", n)
+	}
+}
+
+func TestListServices(t *testing.T) {
+	service := &types.Service{
+		Name:     "billing-webhook",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	queries := make(chan url.Values, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/services" {
+			http.Error(w, fmt.Sprintf("unexpected path %s", r.URL.Path), http.StatusNotFound)
+			return
+		}
+		queries <- r.URL.Query()
+		json.NewEncoder(w).Encode([]*types.Service{service})
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	selector, err := labels.Parse("version=v1")
+	if err != nil {
+		t.Fatalf("parse selector failed: %v", err)
+	}
+
+	// Each option is passed to the server as a query parameter.
+	cases := []struct {
+		opt   registry.ListOption
+		key   string
+		value string
+	}{
+		{registry.WithName(service.Name), "name", service.Name},
+		{registry.WithID("0"), "id", "0"},
+		{registry.WithAddress(service.Address), "address", service.Address},
+		{registry.WithPort(service.Port), "port", "8080"},
+		{registry.WithEndpoint(service.Endpoint), "endpoint", service.Endpoint},
+		{registry.WithSelector(selector), "selector", "version=v1"},
+	}
+
+	for _, c := range cases {
+		services, err := client.ListServices(context.Background(), c.opt)
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+			t.Fatalf("the listed services are %v, should get %v", services, service)
+		}
+
+		query := <-queries
+		if len(query) != 1 || query.Get(c.key) != c.value {
+			t.Fatalf("the query of listing is %v, should only be %s=%s", query, c.key, c.value)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	var deregistered int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			atomic.AddInt32(&deregistered, 1)
+		}
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	for port := 8080; port < 8083; port++ {
+		service := &types.Service{
+			Address:  "localhost",
+			Port:     port,
+			Endpoint: "/webhook",
+		}
+		if err := client.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	if err := client.Close(context.Background()); err != nil {
+		t.Fatalf("close client failed: %v", err)
+	}
+
+	if len(client.services) != 0 {
+		t.Fatalf("the number of registered service is %d, should be 0 after close", len(client.services))
+	}
+
+	if n := atomic.LoadInt32(&deregistered); n != 3 {
+		t.Fatalf("the number of deregister requests is %d, should be 3", n)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := client.Register(context.Background(), service); err == nil {
+		t.Fatalf("register service after close should fail")
+	}
+}
+
+func TestStopHeartbeat(t *testing.T) {
+	// The heartbeats keep backing off, Deregister should abort them instead of waiting.
+	defer func(d time.Duration) { backoff = d }(backoff)
+	backoff = 10 * time.Second
+
+	var registered int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&registered, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&types.Error{Code: types.CodeUnavailable, Message: "unavailable", Retryable: true})
+		}
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := client.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	for i := 0; i < 50 && atomic.LoadInt32(&registered) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&registered) == 0 {
+		t.Fatalf("the heartbeat is not sent in time")
+	}
+
+	start := time.Now()
+	if err := client.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("deregister service takes %v, should not wait for the backoff of heartbeat", d)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	// The registry doesn't reply the deregistrations until the test ends.
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			<-release
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(time.Minute))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := client.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := client.Close(ctx); err == nil {
+		t.Fatalf("close client should fail if the deregistration times out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("close client takes %v, should return once ctx is done", d)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	authenticator := auth.Union(auth.Tokens{"secret-token": "team-a"}, auth.HMAC{"team-b": []byte("secret")})
+
+	users := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticator.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		users <- user
+	}))
+	defer ts.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	for expected, opt := range map[string]Option{
+		"team-a": WithToken("secret-token"),
+		"team-b": WithHMAC("team-b", []byte("secret")),
+	} {
+		client, err := New(WithRegistry(ts.URL), WithHeartbeat(time.Second), opt)
+		if err != nil {
+			t.Fatalf("create client failed: %v", err)
+		}
+
+		if err := client.send(context.Background(), http.MethodPost, service); err != nil {
+			t.Fatalf("register service as %s failed: %v", expected, err)
+		}
+
+		if user := <-users; user != expected {
+			t.Fatalf("the client is authenticated as %q, should be %q", user, expected)
+		}
+	}
+
+	if _, err := New(WithToken("secret-token"), WithHMAC("team-b", []byte("secret"))); err == nil {
+		t.Fatalf("create client with both token and HMAC key should fail")
+	}
+}
+
+func TestWithRegistry(t *testing.T) {
+	for registry, expected := range map[string]string{
+		"http://127.0.0.1:10812":                "http://127.0.0.1:10812",
+		"http://127.0.0.1:10812/":               "http://127.0.0.1:10812",
+		"http://127.0.0.1:10812/register":       "http://127.0.0.1:10812",
+		"https://proxy.example.com/kr/register": "https://proxy.example.com/kr",
+		"https://proxy.example.com/kr":          "https://proxy.example.com/kr",
+	} {
+		client, err := New(WithRegistry(registry))
+		if err != nil {
+			t.Fatalf("create client with registry %q failed: %v", registry, err)
+		}
+
+		if client.registry != expected {
+			t.Fatalf("the base URL of registry %q is %q, should be %q", registry, client.registry, expected)
+		}
+	}
+
+	for _, registry := range []string{"127.0.0.1:10812", "/register", "http://%zz"} {
+		if _, err := New(WithRegistry(registry)); err == nil {
+			t.Fatalf("create client with invalid registry %q should fail", registry)
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&types.Error{
+			Code:    types.CodeInvalidService,
+			Message: "invalid service",
+			Fields:  []types.FieldError{{Field: "address", Detail: "must be a valid address"}},
+		})
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(time.Second))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     -1,
+		Endpoint: "/webhook",
+	}
+
+	err = client.Register(context.Background(), service)
+	if e, ok := err.(*types.ValidationError); !ok || e.Fields[0].Field != "port" {
+		t.Fatalf("register invalid service returns %v, should be the validation error of port", err)
+	}
+
+	if len(client.services) != 0 {
+		t.Fatalf("the number of registered services is %d, should be 0", len(client.services))
+	}
+
+	// The validation errors replied by the server are decoded.
+	err = client.send(context.Background(), http.MethodPost, service)
+	if e, ok := err.(*types.ValidationError); !ok || e.Fields[0].Field != "address" {
+		t.Fatalf("the error replied by server is %v, should be the validation error of address", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Conflict twice, then succeed.
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&types.Error{Code: types.CodeConflict, Message: "conflict", Retryable: true})
+			return
+		}
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(time.Second))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := client.send(context.Background(), http.MethodPost, service); err != nil {
+		t.Fatalf("register service should succeed after retrying conflicts: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("the number of requests is %d, should be 3", n)
+	}
+
+	// The errors which are not retryable are returned right away.
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(&types.Error{Code: types.CodeForbidden, Message: "forbidden"})
+	}))
+	defer forbidden.Close()
+
+	client, err = New(WithRegistry(forbidden.URL), WithHeartbeat(time.Second))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	err = client.send(context.Background(), http.MethodPost, service)
+	if e, ok := err.(*types.Error); !ok || e.Code != types.CodeForbidden {
+		t.Fatalf("register service returns %v, should be the forbidden error", err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("the number of requests is %d, should be 1", n)
+	}
+}
+
+func TestDeregisterNotFound(t *testing.T) {
+	// The service has expired in the registry.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&types.Error{Code: types.CodeNotFound, Message: "service not found"})
+		}
+	}))
+	defer ts.Close()
+
+	client, err := New(WithRegistry(ts.URL), WithHeartbeat(time.Minute))
+	if err != nil {
+		t.Fatalf("create client failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := client.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	if err := client.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister the service which is not found should succeed: %v", err)
+	}
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"io/ioutil"
 	"fmt"
@@ -13,27 +17,37 @@ import (
 )
 
 const (
-	registry = "http://127.0.0.1:10812/register"
+	registry = "http://127.0.0.1:10812"
 )
 
+var tokenFile = flag.String("token-file", "", "File of the bearer token to authenticate to registry, such as the service account token")
+
 func main() {
+	flag.Parse()
+
 	opts := []client.Option{
 		client.WithRegistry(registry),
 		// Heartbeat to registry every 3s.
 		client.WithHeartbeat(3 * time.Second),
 	}
+	if *tokenFile != "" {
+		opts = append(opts, client.WithTokenFile(*tokenFile))
+	}
 	c, err := client.New(opts...)
 	if err != nil {
 		log.Printf("create client failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Register ourself to registry, so server could dispatch message to us.
-	if err := c.Register(&types.Service{
+	service := &types.Service{
+		Name:     "example-client",
 		Address:  "localhost",
 		Port:     10813,
 		Endpoint: "/message",
-	}); err != nil {
+	}
+
+	// Register ourself to registry, so server could dispatch message to us.
+	if err := c.Register(context.Background(), service); err != nil {
 		log.Printf("register service failed: %v\n", err)
 		os.Exit(1)
 	}
@@ -42,10 +56,28 @@ func main() {
 
 	http.HandleFunc("/message", handleMessage)
 
-	if err := http.ListenAndServe(":10813", nil); err != nil {
-		log.Printf("run http server failed: %v\n", err)
+	go func() {
+		if err := http.ListenAndServe(":10813", nil); err != nil {
+			log.Printf("run http server failed: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Deregister ourself on shutdown, so server stops dispatching message to us right away.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// Close deregisters all the services registered by the client, give up if the registry
+	// doesn't reply in time.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		log.Printf("deregister service failed: %v\n", err)
 		os.Exit(1)
 	}
+
+	log.Printf("deregister service succeeded\n")
 }
 
 func handleMessage(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,443 @@
+// Package crd stores the registered services as RegisteredService custom resources, so they
+// are readable by kubectl and other controllers without parsing annotations.
+package crd
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/apicall"
+	"github.com/YaoZengzeng/kr/registry/internal/apierrors"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+var (
+	nameprefix = "service"
+
+	labelKey   = "registered-service-filter"
+	labelValue = "true"
+
+	// The name of service is stored in the label, so we could list the instances of a service efficiently.
+	nameLabelKey = "registered-service-name"
+)
+
+type Registry struct {
+	client dynamic.ResourceInterface
+	lister cache.GenericNamespaceLister
+
+	// Time To Live for a service, default is 60 * time.Second.
+	ttl time.Duration
+	// The period to clean up the expired services in batch, default is 10 * time.Minute.
+	cleanup time.Duration
+
+	broadcaster *registry.Broadcaster
+
+	// stop is closed by Close to stop the informers and the cleanup, wg waits for the cleanup to exit.
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewRegistry(opts ...Option) (*Registry, error) {
+	config, err := newOptions(opts...).RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRegistry(client, 60*time.Second, 10*time.Minute, opts...)
+}
+
+// newRegistry takes the dynamic client, RegisteredService has no typed clientset, so the tests run
+// it on fake.NewSimpleDynamicClient(). The ttl and cleanup could be overridden by opts.
+func newRegistry(client dynamic.Interface, ttl time.Duration, cleanup time.Duration, opts ...Option) (*Registry, error) {
+	o := newOptions(append([]Option{WithTTL(ttl), WithCleanup(cleanup)}, opts...)...)
+
+	// Only watch the services created by registry in the namespace.
+	informers := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, o.Namespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = labels.Set{labelKey: labelValue}.String()
+	})
+
+	serviceInformer := informers.ForResource(gvr)
+
+	registry := &Registry{
+		client:      client.Resource(gvr).Namespace(o.Namespace),
+		lister:      serviceInformer.Lister().ByNamespace(o.Namespace),
+		ttl:         o.TTL,
+		cleanup:     o.Cleanup,
+		broadcaster: registry.NewBroadcaster(),
+		stop:        make(chan struct{}),
+	}
+
+	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    registry.onAdd,
+		UpdateFunc: registry.onUpdate,
+		DeleteFunc: registry.onDelete,
+	})
+
+	informers.Start(registry.stop)
+
+	if !cache.WaitForCacheSync(registry.stop, serviceInformer.Informer().HasSynced) {
+		registry.Close()
+		return nil, fmt.Errorf("failed to wait registered service informer synced")
+	}
+
+	registry.wg.Add(1)
+	go func() {
+		defer registry.wg.Done()
+		registry.Cleanup()
+	}()
+
+	return registry, nil
+}
+
+// Close stops the informers and the cleanup of registry, then closes the channels of watchers.
+// The registered services are kept, they belong to the clients.
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+		r.broadcaster.Close()
+	})
+
+	return nil
+}
+
+func nameOf(service *types.Service) (string, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s-%x", nameprefix, md5.Sum(b)), nil
+}
+
+func specOf(service *types.Service) RegisteredServiceSpec {
+	return RegisteredServiceSpec{
+		Name:     service.Name,
+		ID:       service.ID,
+		Address:  service.Address,
+		Port:     service.Port,
+		Endpoint: service.Endpoint,
+		Metadata: service.Metadata,
+	}
+}
+
+func (rs *RegisteredService) service() *types.Service {
+	return &types.Service{
+		Name:     rs.Spec.Name,
+		ID:       rs.Spec.ID,
+		Address:  rs.Spec.Address,
+		Port:     rs.Spec.Port,
+		Endpoint: rs.Spec.Endpoint,
+		Metadata: rs.Spec.Metadata,
+	}
+}
+
+// expired checks whether the service has no heartbeat within ttl. The service which has been
+// created but not heartbeated yet is checked by its creation time.
+func (rs *RegisteredService) expired(ttl time.Duration, now time.Time) bool {
+	last := rs.Status.LastHeartbeatTime
+	if last.IsZero() {
+		last = rs.CreationTimestamp
+	}
+
+	return last.Add(ttl).Before(now)
+}
+
+func fromObject(obj interface{}) (*RegisteredService, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+
+	rs := &RegisteredService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, rs); err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func toObject(rs *RegisteredService) (*unstructured.Unstructured, error) {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// Register creates or heartbeats the service, every API call returns once ctx is done.
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	return apierrors.Wrap(r.register(ctx, service))
+}
+
+func (r *Registry) register(ctx context.Context, service *types.Service) error {
+	name, err := nameOf(service)
+	if err != nil {
+		return err
+	}
+
+	obj, err := r.lister.Get(name)
+	if errors.IsNotFound(err) {
+		return r.create(ctx, name, service)
+	}
+	if err != nil {
+		return err
+	}
+
+	rs, err := fromObject(obj)
+	if err != nil {
+		return err
+	}
+
+	return r.heartbeat(ctx, rs)
+}
+
+func (r *Registry) create(ctx context.Context, name string, service *types.Service) error {
+	rs := &RegisteredService{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: gvr.GroupVersion().String(),
+			Kind:       kind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				labelKey:     labelValue,
+				nameLabelKey: service.Name,
+			},
+		},
+		Spec: specOf(service),
+	}
+
+	obj, err := toObject(rs)
+	if err != nil {
+		return err
+	}
+
+	var created *unstructured.Unstructured
+	err = apicall.Do(ctx, func() (err error) {
+		created, err = r.client.Create(obj, metav1.CreateOptions{})
+		return err
+	})
+	if errors.IsAlreadyExists(err) {
+		// The service is created by another replica of registry, just heartbeat it.
+		err = apicall.Do(ctx, func() (err error) {
+			created, err = r.client.Get(name, metav1.GetOptions{})
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// The status is ignored on creation, so heartbeat it separately.
+	rs, err = fromObject(created)
+	if err != nil {
+		return err
+	}
+
+	return r.heartbeat(ctx, rs)
+}
+
+// heartbeat only updates the status of service, the spec never changes because the name is
+// the hash of it.
+func (r *Registry) heartbeat(ctx context.Context, rs *RegisteredService) error {
+	now := time.Now()
+	// If we have multiple instances of registry, it's possible that have heartbeats newer than now.
+	if !now.After(rs.Status.LastHeartbeatTime.Time) {
+		return nil
+	}
+
+	rs.Status.LastHeartbeatTime = metav1.NewTime(now)
+	obj, err := toObject(rs)
+	if err != nil {
+		return err
+	}
+
+	return apicall.Do(ctx, func() error {
+		_, err := r.client.UpdateStatus(obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Deregister deletes the registered service right away instead of waiting for it to expire.
+// Deregistering a service which doesn't exist is not an error.
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	return apierrors.Wrap(r.deregister(ctx, service))
+}
+
+func (r *Registry) deregister(ctx context.Context, service *types.Service) error {
+	name, err := nameOf(service)
+	if err != nil {
+		return err
+	}
+
+	err = apicall.Do(ctx, func() error {
+		return r.client.Delete(name, &metav1.DeleteOptions{})
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Cleanup try to clean up the expired services in best effort, just like the Endpoints based registry.
+// It returns after the registry is closed.
+func (r *Registry) Cleanup() {
+	ticker := time.NewTicker(r.cleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		objs, err := r.lister.List(labels.SelectorFromSet(labels.Set{labelKey: labelValue}))
+		if err != nil {
+			log.Printf("list registered services failed in Cleanup(): %v", err)
+		}
+
+		now := time.Now()
+
+		for _, obj := range objs {
+			rs, err := fromObject(obj)
+			if err != nil {
+				log.Printf("failed to convert registered service: %v\n", err)
+				continue
+			}
+
+			if !rs.expired(r.ttl, now) {
+				continue
+			}
+
+			// Only delete the service we have seen, otherwise a heartbeat just now is lost.
+			err = r.client.Delete(rs.Name, &metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{ResourceVersion: &rs.ResourceVersion},
+			})
+			if err != nil && !errors.IsNotFound(err) {
+				log.Printf("failed to delete registered service %v: %v\n", rs.Name, err)
+			}
+		}
+	}
+}
+
+// ListServices lists the services from the cache, ctx is only checked before listing.
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	set := labels.Set{labelKey: labelValue}
+	if options.Name != "" {
+		// Reject the name which can't be a label of RegisteredService, rather than listing the
+		// services of all the names.
+		if errs := validation.IsValidLabelValue(options.Name); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid service name %q: %s", options.Name, strings.Join(errs, "; "))
+		}
+		set[nameLabelKey] = options.Name
+	}
+
+	objs, err := r.lister.List(labels.SelectorFromSet(set))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	res := make([]*types.Service, 0, len(objs))
+	for _, obj := range objs {
+		rs, err := fromObject(obj)
+		if err != nil {
+			log.Printf("failed to convert registered service: %v\n", err)
+			continue
+		}
+
+		if rs.expired(r.ttl, now) {
+			// The registered service has expired, skip.
+			continue
+		}
+
+		service := rs.service()
+		if !options.Matches(service) {
+			continue
+		}
+
+		res = append(res, service)
+	}
+
+	return res, nil
+}
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// serviceOf returns the service of the object, or nil if it's not a registered service.
+func serviceOf(obj interface{}) *types.Service {
+	rs, err := fromObject(obj)
+	if err != nil {
+		log.Printf("failed to convert registered service: %v\n", err)
+		return nil
+	}
+
+	return rs.service()
+}
+
+func (r *Registry) onAdd(obj interface{}) {
+	if service := serviceOf(obj); service != nil {
+		r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+	}
+}
+
+func (r *Registry) onUpdate(oldObj, newObj interface{}) {
+	oldService, newService := serviceOf(oldObj), serviceOf(newObj)
+	if newService == nil {
+		return
+	}
+
+	// Heartbeats only update the status, don't notify them.
+	if oldService != nil && reflect.DeepEqual(oldService, newService) {
+		return
+	}
+
+	r.broadcaster.Notify(registry.Event{Type: registry.Updated, Service: newService})
+}
+
+func (r *Registry) onDelete(obj interface{}) {
+	// The object may be a tombstone if the watch missed the deletion.
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	if service := serviceOf(obj); service != nil {
+		r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+	}
+}
@@ -0,0 +1,259 @@
+package crd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+func TestRegistery(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	r, err := newRegistry(client, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Name:     "billing-webhook",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+
+	err = r.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	name, err := nameOf(service)
+	if err != nil {
+		t.Fatalf("get name of service failed: %v", err)
+	}
+
+	obj, err := client.Resource(gvr).Namespace("default").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get registered service directly failed: %v", err)
+	}
+
+	rs, err := fromObject(obj)
+	if err != nil {
+		t.Fatalf("convert registered service failed: %v", err)
+	}
+
+	// The spec is typed and the heartbeat is recorded in status.
+	if rs.Spec.Address != service.Address || rs.Spec.Port != service.Port || rs.Status.LastHeartbeatTime.IsZero() {
+		t.Fatalf("the registered service is %v, should have spec of %v and heartbeat", rs, service)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	services, err := r.ListServices(context.Background(), registry.WithName("billing-webhook"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should get 1", len(services))
+	}
+
+	if !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the content of service changed after register")
+	}
+}
+
+func TestMetadataNotLabelValue(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	r, err := newRegistry(client, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	// The value is too long and has spaces, it can't be a label value.
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1", "description": strings.Repeat("a", 100) + " / beta"},
+	}
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, s := range []string{"version=v1", "description", "version=v1,description"} {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			t.Fatalf("parse selector failed: %v", err)
+		}
+
+		listed, err := r.ListServices(context.Background(), registry.WithSelector(selector))
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		// The metadata is kept as is, and matched client-side.
+		if len(listed) != 1 || !reflect.DeepEqual(service, listed[0]) {
+			t.Fatalf("the listed services by %q are %v, should get %v", s, listed, service)
+		}
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	// Make service expire quickly.
+	r, err := newRegistry(client, 2*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = r.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// The heartbeat time is stored in seconds, so wait long enough for it to expire.
+	time.Sleep(4 * time.Second)
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should get 0, because it should be expired", len(services))
+	}
+
+	err = r.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service again failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	services, err = r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should get 1", len(services))
+	}
+}
+
+func TestDeregisterService(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	r, err := newRegistry(client, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := r.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = r.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Deregister same service multiple times to test idempotency.
+	for i := 0; i < 2; i++ {
+		if err := r.Deregister(context.Background(), service); err != nil {
+			t.Fatalf("deregister service failed: %v", err)
+		}
+	}
+
+	for _, expected := range []registry.EventType{registry.Added, registry.Removed} {
+		select {
+		case event := <-events:
+			if event.Type != expected {
+				t.Fatalf("the type of event is %v, should be %v", event.Type, expected)
+			}
+			if !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the service of event is %v, should be %v", event.Service, service)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v event", expected)
+		}
+	}
+}
+
+func TestCancelMidCall(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	r, err := newRegistry(client, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	// The creation blocks until it's released, like a request to an unresponsive API server.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	client.PrependReactor("create", gvr.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		close(started)
+		<-release
+		return false, nil, nil
+	})
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.Register(ctx, service)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("register service cancelled mid-call returns %v, should be %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("register service doesn't return after ctx is cancelled")
+	}
+}
@@ -0,0 +1,41 @@
+package crd
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// The CustomResourceDefinition of RegisteredService is in registeredservice.yaml, apply it
+// before using the registry.
+var (
+	group    = "kr.yaozengzeng.io"
+	version  = "v1alpha1"
+	kind     = "RegisteredService"
+	resource = "registeredservices"
+
+	gvr = schema.GroupVersionResource{Group: group, Version: version, Resource: resource}
+)
+
+// RegisteredService is a service registered to registry, the heartbeats only update its status.
+type RegisteredService struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RegisteredServiceSpec   `json:"spec"`
+	Status RegisteredServiceStatus `json:"status,omitempty"`
+}
+
+// RegisteredServiceSpec is the content of types.Service.
+type RegisteredServiceSpec struct {
+	Name     string            `json:"name,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Address  string            `json:"address"`
+	Port     int               `json:"port"`
+	Endpoint string            `json:"endpoint"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type RegisteredServiceStatus struct {
+	// The time of the last heartbeat, the service expires if it's older than TTL.
+	LastHeartbeatTime metav1.Time `json:"lastHeartbeatTime,omitempty"`
+}
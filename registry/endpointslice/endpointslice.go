@@ -0,0 +1,769 @@
+// Package endpointslice stores the registered services in discovery.k8s.io/v1 EndpointSlices. The
+// instances with the same name, port and address type are grouped into the slices of a group, a
+// group spills over into another slice once its slices are full.
+//
+// Each slice has a Lease with the same name shared by its endpoints, the heartbeats only renew
+// the holder of the instance in the lease, so the slice is written only when the instances join
+// or leave.
+//
+// The client-go we depend on has no typed client of discovery.k8s.io/v1, so the slices are served
+// by the dynamic client and converted to the v1beta1 types, the fields used here are the same.
+package endpointslice
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/dynamic/dynamiclister"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coordinationlisterv1 "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/apicall"
+	"github.com/YaoZengzeng/kr/registry/internal/apierrors"
+	"github.com/YaoZengzeng/kr/registry/internal/expiry"
+	"github.com/YaoZengzeng/kr/registry/internal/leases"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+var (
+	nameprefix = "service"
+
+	sliceResource = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+
+	// The well-known labels of EndpointSlice, we are the manager of the slices with managedByValue.
+	managedByKey   = "endpointslice.kubernetes.io/managed-by"
+	managedByValue = "kr"
+	serviceNameKey = "kubernetes.io/service-name"
+
+	// The label of the slices in the same group, the value is the hash of the name, port and
+	// address type shared by the instances in the group.
+	groupKey = "kr/group"
+
+	// The items of the instances in the slice, keyed by the hash of service.
+	annotationKey = "service-content"
+
+	// The most endpoints in a slice, the same as the default of the EndpointSlice controller.
+	maxEndpointsPerSlice = 100
+)
+
+type Registry struct {
+	slices      dynamic.ResourceInterface
+	sliceLister dynamiclister.NamespaceLister
+
+	// The lease of a slice is shared by its endpoints, the holders are the keys of the items.
+	leases      *leases.Client
+	leaseLister coordinationlisterv1.LeaseNamespaceLister
+
+	// Time To Live for a service, default is 60 * time.Second.
+	ttl time.Duration
+	// The period to clean up the expired services in batch, default is 10 * time.Minute.
+	cleanup time.Duration
+
+	broadcaster *registry.Broadcaster
+	// expiry notifies the services whose holders in the leases expire, before they are cleaned up.
+	expiry *expiry.Tracker
+
+	// stop is closed by Close to stop the informers and the cleanup, wg waits for the goroutines
+	// of registry to exit.
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type Item struct {
+	Service *types.Service `json:"service"`
+	// The time the item is added to the slice, it expires the service if its holder in the
+	// lease is lost.
+	Update time.Time `json:"update"`
+}
+
+func NewRegistry(opts ...Option) (*Registry, error) {
+	config, err := newOptions(opts...).RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRegistry(clientset, dynamicClient, 60*time.Second, 10*time.Minute, opts...)
+}
+
+// newRegistry takes the clientset for the leases and the dynamic client for the v1 slices, which the
+// typed clientset of this client-go lacks, so the tests pass the fakes of both. The ttl and cleanup
+// could be overridden by opts.
+func newRegistry(clientset kubernetes.Interface, dynamicClient dynamic.Interface, ttl time.Duration, cleanup time.Duration, opts ...Option) (*Registry, error) {
+	o := newOptions(append([]Option{WithTTL(ttl), WithCleanup(cleanup)}, opts...)...)
+
+	// Only watch the slices and leases managed by registry in the namespace.
+	managed := labels.Set{managedByKey: managedByValue}
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = managed.String()
+	}
+
+	dynamicInformers := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, o.Namespace, tweak)
+	sliceInformer := dynamicInformers.ForResource(sliceResource).Informer()
+
+	informers := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(o.Namespace),
+		informers.WithTweakListOptions(tweak),
+	)
+	leaseInformer := informers.Coordination().V1().Leases().Informer()
+	leaseLister := informers.Coordination().V1().Leases().Lister().Leases(o.Namespace)
+
+	registry := &Registry{
+		slices:      dynamicClient.Resource(sliceResource).Namespace(o.Namespace),
+		sliceLister: dynamiclister.New(sliceInformer.GetIndexer(), sliceResource).Namespace(o.Namespace),
+		leases:      leases.NewClient(clientset.CoordinationV1().Leases(o.Namespace), leaseLister, managed, o.TTL, clock.RealClock{}),
+		leaseLister: leaseLister,
+		ttl:         o.TTL,
+		cleanup:     o.Cleanup,
+		broadcaster: registry.NewBroadcaster(),
+		stop:        make(chan struct{}),
+	}
+	registry.expiry = expiry.NewTracker(clock.RealClock{}, registry.onExpired, registry.onRevived)
+
+	sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    registry.onAdd,
+		UpdateFunc: registry.onUpdate,
+		DeleteFunc: registry.onDelete,
+	})
+	leaseInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { registry.onLease(nil, obj) },
+		UpdateFunc: registry.onLease,
+	})
+
+	dynamicInformers.Start(registry.stop)
+	informers.Start(registry.stop)
+
+	if !cache.WaitForCacheSync(registry.stop, sliceInformer.HasSynced, leaseInformer.HasSynced) {
+		registry.Close()
+		return nil, fmt.Errorf("failed to wait endpoint slice and lease informers synced")
+	}
+
+	registry.wg.Add(2)
+	go func() {
+		defer registry.wg.Done()
+		registry.expiry.Run(registry.stop)
+	}()
+	go func() {
+		defer registry.wg.Done()
+		registry.Cleanup()
+	}()
+
+	return registry, nil
+}
+
+// Close stops the informers and the cleanup of registry, then closes the channels of watchers.
+// The registered services are kept, they belong to the clients.
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+		r.broadcaster.Close()
+	})
+
+	return nil
+}
+
+func addressTypeOf(service *types.Service) discoveryv1beta1.AddressType {
+	ip := net.ParseIP(service.Address)
+	switch {
+	case ip == nil:
+		return discoveryv1beta1.AddressTypeFQDN
+	case ip.To4() != nil:
+		return discoveryv1beta1.AddressTypeIPv4
+	default:
+		return discoveryv1beta1.AddressTypeIPv6
+	}
+}
+
+// groupOf returns the group of the slices holding the service. The ports and address type are
+// shared by all the endpoints in a slice, so the instances of the same service are grouped by them too.
+func groupOf(service *types.Service) string {
+	group := fmt.Sprintf("%s/%d/%s", service.Name, service.Port, addressTypeOf(service))
+	return fmt.Sprintf("%x", md5.Sum([]byte(group)))
+}
+
+// sliceNameOf returns the name of the slice with the index in the group, it's the name of its
+// lease too.
+func sliceNameOf(group string, index int) string {
+	return fmt.Sprintf("%s-%s-%d", nameprefix, group, index)
+}
+
+func keyOf(service *types.Service) (string, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(b)), nil
+}
+
+func itemsOf(slice metav1.Object) (map[string]*Item, error) {
+	items := make(map[string]*Item)
+	if value, ok := slice.GetAnnotations()[annotationKey]; ok {
+		if err := json.Unmarshal([]byte(value), &items); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// buildSlice builds the slice with the items. The slice is copied from old if it exists,
+// otherwise it's created with the name for the group of service.
+func buildSlice(name string, service *types.Service, old *unstructured.Unstructured, items map[string]*Item) (*unstructured.Unstructured, error) {
+	slice := &discoveryv1beta1.EndpointSlice{}
+	if old != nil {
+		// The conversion never modifies the object in cache.
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(old.Object, slice); err != nil {
+			return nil, err
+		}
+	} else {
+		port := int32(service.Port)
+		protocol := apiv1.ProtocolTCP
+		slice = &discoveryv1beta1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					managedByKey:   managedByValue,
+					serviceNameKey: service.Name,
+					groupKey:       groupOf(service),
+				},
+			},
+			AddressType: addressTypeOf(service),
+			Ports: []discoveryv1beta1.EndpointPort{
+				{
+					Port:     &port,
+					Protocol: &protocol,
+				},
+			},
+		}
+	}
+	slice.APIVersion = sliceResource.GroupVersion().String()
+	slice.Kind = "EndpointSlice"
+
+	value, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	if slice.Annotations == nil {
+		slice.Annotations = make(map[string]string)
+	}
+	slice.Annotations[annotationKey] = string(value)
+
+	// Sort the endpoints to avoid needless changes of the slice.
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ready := true
+	slice.Endpoints = make([]discoveryv1beta1.Endpoint, 0, len(keys))
+	for _, key := range keys {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1beta1.Endpoint{
+			Addresses:  []string{items[key].Service.Address},
+			Conditions: discoveryv1beta1.EndpointConditions{Ready: &ready},
+		})
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(slice)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// listSlices lists the slices matching the selector from cache, or from the API server if fresh.
+func (r *Registry) listSlices(ctx context.Context, selector labels.Selector, fresh bool) ([]*unstructured.Unstructured, error) {
+	if !fresh {
+		return r.sliceLister.List(selector)
+	}
+
+	var list *unstructured.UnstructuredList
+	err := apicall.Do(ctx, func() (err error) {
+		list, err = r.slices.List(metav1.ListOptions{LabelSelector: selector.String()})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices := make([]*unstructured.Unstructured, 0, len(list.Items))
+	for i := range list.Items {
+		slices = append(slices, &list.Items[i])
+	}
+	return slices, nil
+}
+
+func groupSelector(service *types.Service) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{managedByKey: managedByValue, groupKey: groupOf(service)})
+}
+
+// addItem adds the service to a slice of its group unless it's in one already, and returns the
+// name of the slice holding it. The instances of the group share the slices, so the writes are
+// retried with the latest slices on conflicts.
+func (r *Registry) addItem(ctx context.Context, key string, service *types.Service) (string, error) {
+	group := groupOf(service)
+
+	fresh := false
+	retriable := func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err) || errors.IsNotFound(err)
+	}
+
+	var name string
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		// The cache may be stale, list the latest slices when retrying.
+		slices, err := r.listSlices(ctx, groupSelector(service), fresh)
+		fresh = true
+		if err != nil {
+			return err
+		}
+		sort.Slice(slices, func(i, j int) bool { return slices[i].GetName() < slices[j].GetName() })
+
+		used := make(map[string]bool)
+		var free *unstructured.Unstructured
+		var freeItems map[string]*Item
+		for _, slice := range slices {
+			used[slice.GetName()] = true
+
+			items, err := itemsOf(slice)
+			if err != nil {
+				log.Printf("failed to unmarshal registered services from %v\n", slice.GetName())
+				continue
+			}
+			if _, ok := items[key]; ok {
+				name = slice.GetName()
+				return nil
+			}
+			if free == nil && len(items) < maxEndpointsPerSlice {
+				free, freeItems = slice, items
+			}
+		}
+
+		item := &Item{Service: service, Update: time.Now()}
+		if free != nil {
+			freeItems[key] = item
+			slice, err := buildSlice(free.GetName(), service, free, freeItems)
+			if err != nil {
+				return err
+			}
+
+			name = free.GetName()
+			return apicall.Do(ctx, func() error {
+				_, err := r.slices.Update(slice, metav1.UpdateOptions{})
+				return err
+			})
+		}
+
+		// All the slices of the group are full, create another one.
+		for i := 0; ; i++ {
+			if name = sliceNameOf(group, i); !used[name] {
+				break
+			}
+		}
+		slice, err := buildSlice(name, service, nil, map[string]*Item{key: item})
+		if err != nil {
+			return err
+		}
+
+		return apicall.Do(ctx, func() error {
+			_, err := r.slices.Create(slice, metav1.CreateOptions{})
+			return err
+		})
+	})
+
+	return name, err
+}
+
+// removeItems removes the items matching remove from the slice with the name, the slice and its
+// lease are deleted if no item left, otherwise the removed holders are released from the lease.
+func (r *Registry) removeItems(ctx context.Context, name string, remove func(key string, item *Item) bool) error {
+	var removed []string
+	deleted := false
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		removed, deleted = nil, false
+
+		// Always get the latest slice, the items added lately must be kept.
+		var slice *unstructured.Unstructured
+		err := apicall.Do(ctx, func() (err error) {
+			slice, err = r.slices.Get(name, metav1.GetOptions{})
+			return err
+		})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		items, err := itemsOf(slice)
+		if err != nil {
+			return err
+		}
+		for key, item := range items {
+			if remove(key, item) {
+				removed = append(removed, key)
+				delete(items, key)
+			}
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+
+		if len(items) == 0 {
+			// Only delete the slice we have seen, otherwise an instance added just now is lost.
+			resourceVersion := slice.GetResourceVersion()
+			err := apicall.Do(ctx, func() error {
+				return r.slices.Delete(name, &metav1.DeleteOptions{
+					Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+				})
+			})
+			if err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			deleted = true
+			return nil
+		}
+
+		updated, err := buildSlice(name, nil, slice, items)
+		if err != nil {
+			return err
+		}
+		return apicall.Do(ctx, func() error {
+			_, err := r.slices.Update(updated, metav1.UpdateOptions{})
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if deleted {
+		return r.leases.Delete(ctx, name, "")
+	}
+	if len(removed) != 0 {
+		return r.leases.Release(ctx, name, removed...)
+	}
+	return nil
+}
+
+// Register adds the service to a slice of its group if it's not there, then renews its holder
+// in the lease of the slice. Every API call returns once ctx is done.
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	key, err := keyOf(service)
+	if err != nil {
+		return err
+	}
+
+	name, err := r.addItem(ctx, key, service)
+	if err != nil {
+		return apierrors.Wrap(err)
+	}
+
+	return apierrors.Wrap(r.leases.Renew(ctx, name, key))
+}
+
+// Deregister removes the service from its slice right away instead of waiting for it to expire.
+// Deregistering a service which doesn't exist is not an error.
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	key, err := keyOf(service)
+	if err != nil {
+		return err
+	}
+
+	// The cache may not have the slice the service is added to just now.
+	slices, err := r.listSlices(ctx, groupSelector(service), true)
+	if err != nil {
+		return apierrors.Wrap(err)
+	}
+
+	for _, slice := range slices {
+		items, err := itemsOf(slice)
+		if err != nil {
+			continue
+		}
+		if _, ok := items[key]; !ok {
+			continue
+		}
+
+		err = r.removeItems(ctx, slice.GetName(), func(k string, _ *Item) bool {
+			return k == key
+		})
+		if err != nil {
+			return apierrors.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// expiresAt returns when the service with the key in the slice with the name expires.
+func (r *Registry) expiresAt(name string, key string, item *Item) time.Time {
+	return r.leases.ExpiresAt(name, key, item.Update.Add(r.ttl))
+}
+
+// Cleanup try to clean up the expired services in best effort, just like the Endpoints based registry.
+// It returns after the registry is closed.
+func (r *Registry) Cleanup() {
+	ticker := time.NewTicker(r.cleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		managed := labels.SelectorFromSet(labels.Set{managedByKey: managedByValue})
+		slices, err := r.sliceLister.List(managed)
+		if err != nil {
+			log.Printf("list endpoint slices failed in Cleanup(): %v\n", err)
+		}
+
+		for _, slice := range slices {
+			name := slice.GetName()
+			expired := func(key string, item *Item) bool {
+				return r.expiresAt(name, key, item).Before(time.Now())
+			}
+
+			items, err := itemsOf(slice)
+			if err != nil {
+				log.Printf("failed to unmarshal registered services from %v\n", name)
+				continue
+			}
+
+			for key, item := range items {
+				if !expired(key, item) {
+					continue
+				}
+
+				// The registered services have expired, clean them up.
+				if err := r.removeItems(context.Background(), name, expired); err != nil {
+					log.Printf("failed to clean up endpoint slice %v: %v\n", name, err)
+				}
+				break
+			}
+		}
+
+		// The lease renewed while its slice was being deleted is left without slice.
+		all, err := r.leaseLister.List(managed)
+		if err != nil {
+			log.Printf("list leases failed in Cleanup(): %v\n", err)
+		}
+
+		for _, lease := range all {
+			if _, err := r.sliceLister.Get(lease.Name); !errors.IsNotFound(err) || !leaseExpired(lease) {
+				continue
+			}
+
+			if err := r.leases.Delete(context.Background(), lease.Name, lease.ResourceVersion); err != nil {
+				log.Printf("failed to clean up lease %v: %v\n", lease.Name, err)
+			}
+		}
+	}
+}
+
+// leaseExpired checks whether all the holders of lease have expired.
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	now := time.Now()
+	for holder := range leases.Holders(lease) {
+		if deadline, ok := leases.Deadline(lease, holder); ok && !deadline.Before(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListServices lists the services from the cache, ctx is only checked before listing.
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	set := labels.Set{managedByKey: managedByValue}
+	if options.Name != "" {
+		// The name is a label value of the slices, an invalid one would match every slice.
+		if errs := validation.IsValidLabelValue(options.Name); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid service name %q: %s", options.Name, strings.Join(errs, "; "))
+		}
+		set[serviceNameKey] = options.Name
+	}
+
+	slices, err := r.sliceLister.List(labels.SelectorFromSet(set))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	// The same instance may be added to two slices of its group by the replicas of registry
+	// at the same time, list it once.
+	seen := make(map[string]bool)
+	var res []*types.Service
+	for _, slice := range slices {
+		items, err := itemsOf(slice)
+		if err != nil {
+			log.Printf("failed to unmarshal registered services from %v\n", slice.GetName())
+			continue
+		}
+
+		for key, item := range items {
+			if seen[key] || r.expiresAt(slice.GetName(), key, item).Before(now) {
+				// The registered service has expired, skip.
+				continue
+			}
+
+			if !options.Matches(item.Service) {
+				continue
+			}
+
+			seen[key] = true
+			res = append(res, item.Service)
+		}
+	}
+
+	return res, nil
+}
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// itemsOfObject returns the name of slice and the items in it, or nil if the object is not a slice.
+func itemsOfObject(obj interface{}) (string, map[string]*Item) {
+	slice, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return "", nil
+	}
+
+	items, err := itemsOf(slice)
+	if err != nil {
+		log.Printf("failed to unmarshal registered services from %v\n", slice.GetName())
+		return "", nil
+	}
+
+	return slice.GetName(), items
+}
+
+// added notifies the service added to the slice with the name, and tracks its expiry.
+func (r *Registry) added(name string, key string, item *Item) {
+	r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: item.Service})
+	r.expiry.Track(key, item.Service, r.expiresAt(name, key, item))
+}
+
+// removed notifies the service removed from its slice, unless it has been notified on expiry.
+func (r *Registry) removed(key string, item *Item) {
+	if r.expiry.Forget(key) {
+		return
+	}
+	r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: item.Service})
+}
+
+func (r *Registry) onAdd(obj interface{}) {
+	name, items := itemsOfObject(obj)
+	for key, item := range items {
+		r.added(name, key, item)
+	}
+}
+
+func (r *Registry) onUpdate(oldObj, newObj interface{}) {
+	_, oldItems := itemsOfObject(oldObj)
+	name, newItems := itemsOfObject(newObj)
+
+	// The items are keyed by the hash of service, the slice only changes when they join or leave.
+	for key, item := range newItems {
+		if _, ok := oldItems[key]; !ok {
+			r.added(name, key, item)
+		}
+	}
+	for key, item := range oldItems {
+		if _, ok := newItems[key]; !ok {
+			r.removed(key, item)
+		}
+	}
+}
+
+func (r *Registry) onDelete(obj interface{}) {
+	// The object may be a tombstone if the watch missed the deletion.
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	_, items := itemsOfObject(obj)
+	for key, item := range items {
+		r.removed(key, item)
+	}
+}
+
+// onLease extends the deadlines of the holders renewed in the lease, the expired services are
+// notified as added again.
+func (r *Registry) onLease(oldObj, newObj interface{}) {
+	lease, ok := newObj.(*coordinationv1.Lease)
+	if !ok {
+		return
+	}
+
+	renewed := make(map[string]time.Time)
+	if old, ok := oldObj.(*coordinationv1.Lease); ok {
+		renewed = leases.Holders(old)
+	}
+
+	for holder, renewTime := range leases.Holders(lease) {
+		if renewed[holder].Equal(renewTime) {
+			continue
+		}
+		if deadline, ok := leases.Deadline(lease, holder); ok {
+			r.expiry.Extend(holder, deadline)
+		}
+	}
+}
+
+// onExpired notifies the expired service as removed. The item is kept in its slice until the
+// cleanup, so the watchers are notified here rather than by its removal.
+func (r *Registry) onExpired(service *types.Service) {
+	r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+}
+
+// onRevived notifies the expired service which heartbeats again as added.
+func (r *Registry) onRevived(service *types.Service) {
+	r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+}
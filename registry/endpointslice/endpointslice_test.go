@@ -0,0 +1,441 @@
+package endpointslice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/leases"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+func newTestRegistry(t *testing.T, ttl time.Duration, cleanup time.Duration) (*Registry, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	clientset := fake.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	r, err := newRegistry(clientset, dynamicClient, ttl, cleanup)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	return r, clientset, dynamicClient
+}
+
+func TestRegistery(t *testing.T) {
+	r, clientset, dynamicClient := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	services := []*types.Service{
+		{Name: "billing-webhook", ID: "0", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing-webhook", ID: "1", Address: "10.0.0.2", Port: 8080, Endpoint: "/webhook"},
+		{Name: "message", ID: "0", Address: "localhost", Port: 8082, Endpoint: "/message"},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	slices, err := dynamicClient.Resource(sliceResource).Namespace("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoint slices directly failed: %v", err)
+	}
+
+	// The instances of billing-webhook are grouped into one slice.
+	if len(slices.Items) != 2 {
+		t.Fatalf("the number of endpoint slices is %d, should get 2", len(slices.Items))
+	}
+
+	for _, slice := range slices.Items {
+		if slice.GetAPIVersion() != "discovery.k8s.io/v1" {
+			t.Fatalf("the api version of endpoint slice is %s, should get discovery.k8s.io/v1", slice.GetAPIVersion())
+		}
+
+		expected := 1
+		if slice.GetLabels()[serviceNameKey] == "billing-webhook" {
+			expected = 2
+		}
+		endpoints, _, err := unstructured.NestedSlice(slice.Object, "endpoints")
+		if err != nil || len(endpoints) != expected {
+			t.Fatalf("the number of endpoints in slice of %s is %d, should get %d", slice.GetLabels()[serviceNameKey], len(endpoints), expected)
+		}
+	}
+
+	// The endpoints of a slice share its lease.
+	leaseList, err := clientset.CoordinationV1().Leases("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list leases directly failed: %v", err)
+	}
+
+	if len(leaseList.Items) != 2 {
+		t.Fatalf("the number of leases is %d, should get 2", len(leaseList.Items))
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	listed, err := r.ListServices(context.Background(), registry.WithName("billing-webhook"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("the number of listed services is %d, should get 2", len(listed))
+	}
+
+	listed, err = r.ListServices(context.Background(), registry.WithName("message"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 1 || !reflect.DeepEqual(services[2], listed[0]) {
+		t.Fatalf("the listed services are %v, should get %v", listed, services[2])
+	}
+}
+
+func TestMetadataNotLabelValue(t *testing.T) {
+	r, _, _ := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	// The value is too long and has spaces, it can't be a label value.
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1", "description": strings.Repeat("a", 100) + " / beta"},
+	}
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, s := range []string{"version=v1", "description", "version=v1,description"} {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			t.Fatalf("parse selector failed: %v", err)
+		}
+
+		listed, err := r.ListServices(context.Background(), registry.WithSelector(selector))
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		// The metadata is kept as is, and matched client-side.
+		if len(listed) != 1 || !reflect.DeepEqual(service, listed[0]) {
+			t.Fatalf("the listed services by %q are %v, should get %v", s, listed, service)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	r, clientset, dynamicClient := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	service := &types.Service{Name: "billing-webhook", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"}
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	key, err := keyOf(service)
+	if err != nil {
+		t.Fatalf("hash service failed: %v", err)
+	}
+	name := sliceNameOf(groupOf(service), 0)
+
+	lease, err := clientset.CoordinationV1().Leases("default").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease directly failed: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	dynamicClient.ClearActions()
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service again failed: %v", err)
+	}
+
+	// The heartbeat renews the lease and leaves the slice alone.
+	for _, action := range dynamicClient.Actions() {
+		if verb := action.GetVerb(); verb != "get" && verb != "list" && verb != "watch" {
+			t.Fatalf("the endpoint slice is written by heartbeat: %s", verb)
+		}
+	}
+
+	renewed, err := clientset.CoordinationV1().Leases("default").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease directly failed: %v", err)
+	}
+	if !leases.Holders(renewed)[key].After(leases.Holders(lease)[key]) {
+		t.Fatalf("the holder of service in lease is not renewed by heartbeat")
+	}
+}
+
+func TestDeregisterService(t *testing.T) {
+	r, clientset, dynamicClient := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	services := []*types.Service{
+		{Name: "billing-webhook", ID: "0", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing-webhook", ID: "1", Address: "10.0.0.2", Port: 8080, Endpoint: "/webhook"},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// Deregister same service multiple times to test idempotency.
+	for i := 0; i < 2; i++ {
+		if err := r.Deregister(context.Background(), services[0]); err != nil {
+			t.Fatalf("deregister service failed: %v", err)
+		}
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	listed, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 1 || !reflect.DeepEqual(services[1], listed[0]) {
+		t.Fatalf("the listed services are %v, should get %v", listed, services[1])
+	}
+
+	if err := r.Deregister(context.Background(), services[1]); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	slices, err := dynamicClient.Resource(sliceResource).Namespace("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoint slices directly failed: %v", err)
+	}
+
+	if len(slices.Items) != 0 {
+		t.Fatalf("the number of endpoint slices is %d, should get 0 after all instances deregistered", len(slices.Items))
+	}
+
+	leaseList, err := clientset.CoordinationV1().Leases("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list leases directly failed: %v", err)
+	}
+
+	if len(leaseList.Items) != 0 {
+		t.Fatalf("the number of leases is %d, should get 0 after all instances deregistered", len(leaseList.Items))
+	}
+}
+
+func TestServiceCleanup(t *testing.T) {
+	// Make service expire and cleanup quickly.
+	r, clientset, dynamicClient := newTestRegistry(t, 1*time.Second, 2*time.Second)
+	defer r.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Wait service to expire and cleanup.
+	time.Sleep(3 * time.Second)
+
+	slices, err := dynamicClient.Resource(sliceResource).Namespace("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoint slices directly failed: %v", err)
+	}
+
+	if len(slices.Items) != 0 {
+		t.Fatalf("the number of endpoint slices is %d, should get 0, because it get expired and cleanup", len(slices.Items))
+	}
+
+	leaseList, err := clientset.CoordinationV1().Leases("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list leases directly failed: %v", err)
+	}
+
+	if len(leaseList.Items) != 0 {
+		t.Fatalf("the number of leases is %d, should get 0, because it get expired and cleanup", len(leaseList.Items))
+	}
+}
+
+func TestSliceSpillover(t *testing.T) {
+	defer func(max int) { maxEndpointsPerSlice = max }(maxEndpointsPerSlice)
+	maxEndpointsPerSlice = 2
+
+	r, clientset, dynamicClient := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	var services []*types.Service
+	for i := 0; i < 3; i++ {
+		service := &types.Service{Name: "billing-webhook", ID: fmt.Sprint(i), Address: fmt.Sprintf("10.0.0.%d", i+1), Port: 8080, Endpoint: "/webhook"}
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+		services = append(services, service)
+
+		// The fake clientset doesn't check the resource version, so the update with a stale
+		// slice from cache is not rejected with conflict as the API server does.
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	slices, err := dynamicClient.Resource(sliceResource).Namespace("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoint slices directly failed: %v", err)
+	}
+
+	// The group spills over into another slice once the first one is full.
+	if len(slices.Items) != 2 {
+		t.Fatalf("the number of endpoint slices is %d, should get 2", len(slices.Items))
+	}
+
+	leaseList, err := clientset.CoordinationV1().Leases("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list leases directly failed: %v", err)
+	}
+
+	if len(leaseList.Items) != 2 {
+		t.Fatalf("the number of leases is %d, should get 2", len(leaseList.Items))
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	listed, err := r.ListServices(context.Background(), registry.WithName("billing-webhook"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 3 {
+		t.Fatalf("the number of listed services is %d, should get 3", len(listed))
+	}
+
+	// Heartbeats never add the instances again.
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service again failed: %v", err)
+		}
+	}
+
+	slices, err = dynamicClient.Resource(sliceResource).Namespace("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoint slices directly failed: %v", err)
+	}
+
+	if len(slices.Items) != 2 {
+		t.Fatalf("the number of endpoint slices is %d after heartbeats, should get 2", len(slices.Items))
+	}
+}
+
+func TestExpiryEvents(t *testing.T) {
+	r, _, _ := newTestRegistry(t, 1*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	events, err := r.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	expectEvent := func(expected registry.EventType) {
+		select {
+		case event := <-events:
+			if event.Type != expected || !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, expected, service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v event", expected)
+		}
+	}
+
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(registry.Added)
+
+	// The slice is kept until the cleanup, but the service is removed for the watchers once its
+	// holder in the lease expires.
+	expectEvent(registry.Removed)
+
+	// The expired service heartbeats again before it's cleaned up, then it's added back.
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(registry.Added)
+
+	// Deregistering notifies the service as removed once.
+	if err := r.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+	expectEvent(registry.Removed)
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v %v after deregister", event.Type, event.Service)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCancelMidCall(t *testing.T) {
+	r, _, dynamicClient := newTestRegistry(t, 60*time.Second, 10*time.Minute)
+	defer r.Close()
+
+	// The creation blocks until it's released, like a request to an unresponsive API server.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	dynamicClient.PrependReactor("create", "endpointslices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		close(started)
+		<-release
+		return false, nil, nil
+	})
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- r.Register(ctx, service)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("register service cancelled mid-call returns %v, should be %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("register service doesn't return after ctx is cancelled")
+	}
+}
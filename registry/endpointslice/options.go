@@ -0,0 +1,53 @@
+package endpointslice
+
+import (
+	"time"
+
+	"github.com/YaoZengzeng/kr/registry/internal/kubeconfig"
+)
+
+type options struct {
+	kubeconfig.Options
+}
+
+type Option func(*options)
+
+func WithKubeconfig(kubeconfig string) Option {
+	return func(o *options) {
+		o.Kubeconfig = kubeconfig
+	}
+}
+
+func WithContext(context string) Option {
+	return func(o *options) {
+		o.Context = context
+	}
+}
+
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.Namespace = namespace
+	}
+}
+
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.TTL = ttl
+	}
+}
+
+func WithCleanup(cleanup time.Duration) Option {
+	return func(o *options) {
+		o.Cleanup = cleanup
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{Options: kubeconfig.NewOptions()}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
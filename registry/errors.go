@@ -0,0 +1,16 @@
+package registry
+
+import "errors"
+
+// The backends wrap their errors with these, so the server could reply the matching status codes
+// and the clients could decide whether to retry.
+var (
+	// ErrConflict means the service was changed concurrently, retrying may succeed.
+	ErrConflict = errors.New("conflict")
+	// ErrForbidden means the registry is not allowed to access its storage.
+	ErrForbidden = errors.New("forbidden")
+	// ErrTimeout means the storage of registry didn't respond in time.
+	ErrTimeout = errors.New("timeout")
+	// ErrUnavailable means the storage of registry can't be reached for now.
+	ErrUnavailable = errors.New("registry is unavailable")
+)
@@ -0,0 +1,436 @@
+// Etcd based registry stores each service in a key of etcd v3 attached to a lease, so etcd
+// deletes it when the service stops registering. The keys are watched to keep a local cache
+// for listing.
+package etcd
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// The interval to watch again after the watch is broken, e.g. etcd is unreachable.
+var rewatchInterval = time.Second
+
+type Registry struct {
+	client *clientv3.Client
+	// closeClient is true if the client is created by registry, so it's closed with registry.
+	closeClient bool
+
+	prefix string
+	ttl    time.Duration
+
+	mtx sync.RWMutex
+	// cache of the services under prefix, key is the key in etcd.
+	cache map[string]*entry
+	// revision of etcd the cache is up to date with, progress is closed and replaced when it
+	// moves forward.
+	revision int64
+	progress chan struct{}
+
+	broadcaster *registry.Broadcaster
+
+	// stop is closed by Close to stop watching, cancel cancels the in-flight requests of watching.
+	stop      chan struct{}
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type entry struct {
+	service *types.Service
+	lease   clientv3.LeaseID
+}
+
+type Item struct {
+	Service *types.Service `json:"service"`
+	Update  time.Time      `json:"update"`
+}
+
+func NewRegistry(opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   o.endpoints,
+		DialTimeout: o.dialTimeout,
+		TLS:         o.tls,
+		Username:    o.username,
+		Password:    o.password,
+	})
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	r, err := newRegistry(client, opts...)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	r.closeClient = true
+
+	return r, nil
+}
+
+// Easy for test: take the client of an embedded etcd as input.
+func newRegistry(client *clientv3.Client, opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Registry{
+		client:      client,
+		prefix:      o.prefix,
+		ttl:         o.ttl,
+		cache:       make(map[string]*entry),
+		progress:    make(chan struct{}),
+		broadcaster: registry.NewBroadcaster(),
+		stop:        make(chan struct{}),
+		cancel:      cancel,
+	}
+
+	if err := r.sync(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run(ctx)
+	}()
+
+	return r, nil
+}
+
+// Close stops watching etcd and closes the channels of the watchers, the client is closed if
+// it's created by registry.
+func (r *Registry) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.cancel()
+		r.wg.Wait()
+		r.broadcaster.Close()
+
+		if r.closeClient {
+			err = r.client.Close()
+		}
+	})
+	return err
+}
+
+// key returns the key of service in etcd, it's the hash of service under its name, so the
+// instances of a service are listed by prefix.
+func (r *Registry) key(service *types.Service) (string, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(b)
+	return r.prefix + service.Name + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, err := r.key(service)
+	if err != nil {
+		return err
+	}
+
+	// The key is the hash of service, so the registered service never changes, just keep its
+	// lease alive.
+	r.mtx.RLock()
+	e, exist := r.cache[key]
+	r.mtx.RUnlock()
+	if exist && e.lease != clientv3.NoLease {
+		_, err := r.client.KeepAliveOnce(ctx, e.lease)
+		if err == nil {
+			return nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return wrap(err)
+		}
+	}
+
+	value, err := json.Marshal(&Item{
+		Service: service,
+		Update:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	lease, err := r.client.Grant(ctx, int64(math.Ceil(r.ttl.Seconds())))
+	if err != nil {
+		return wrap(err)
+	}
+
+	// The lease previously attached to the key, if any, expires without keys.
+	resp, err := r.client.Put(ctx, key, string(value), clientv3.WithLease(lease.ID))
+	if err != nil {
+		return wrap(err)
+	}
+
+	// Wait for the cache, so the registered service is listed right after.
+	return r.waitRevision(ctx, resp.Header.Revision)
+}
+
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, err := r.key(service)
+	if err != nil {
+		return err
+	}
+
+	// Revoking the lease deletes the key too, so the lease doesn't linger until it expires.
+	r.mtx.RLock()
+	e, exist := r.cache[key]
+	r.mtx.RUnlock()
+	if exist && e.lease != clientv3.NoLease {
+		resp, err := r.client.Revoke(ctx, e.lease)
+		if err == nil {
+			return r.waitRevision(ctx, resp.Header.Revision)
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return wrap(err)
+		}
+	}
+
+	resp, err := r.client.Delete(ctx, key)
+	if err != nil {
+		return wrap(err)
+	}
+
+	return r.waitRevision(ctx, resp.Header.Revision)
+}
+
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	res := make([]*types.Service, 0, len(r.cache))
+	for _, e := range r.cache {
+		if !options.Matches(e.service) {
+			continue
+		}
+
+		res = append(res, e.service)
+	}
+
+	return res, nil
+}
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// waitRevision waits until the cache is up to date with the revision. It returns ErrTimeout if
+// ctx is done first, the change is made in etcd already but not seen by the watch yet.
+func (r *Registry) waitRevision(ctx context.Context, revision int64) error {
+	for {
+		r.mtx.RLock()
+		current, progress := r.revision, r.progress
+		r.mtx.RUnlock()
+
+		if current >= revision {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: wait for revision %d: %v", registry.ErrTimeout, revision, ctx.Err())
+		case <-r.stop:
+			return fmt.Errorf("registry is closed")
+		}
+	}
+}
+
+// sync lists the services under prefix and replaces the cache with them, the differences are
+// notified to the watchers.
+func (r *Registry) sync(ctx context.Context) error {
+	resp, err := r.client.Get(ctx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return wrap(err)
+	}
+
+	cache := make(map[string]*entry, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		e, err := decode(kv)
+		if err != nil {
+			log.Printf("failed to unmarshal registered service from %s: %v\n", kv.Key, err)
+			continue
+		}
+		cache[string(kv.Key)] = e
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for key, e := range cache {
+		if _, exist := r.cache[key]; !exist {
+			r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: e.service})
+		}
+	}
+	for key, e := range r.cache {
+		if _, exist := cache[key]; !exist {
+			r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: e.service})
+		}
+	}
+
+	r.cache = cache
+	r.advance(resp.Header.Revision)
+
+	return nil
+}
+
+// run watches the services under prefix until the registry is closed. If the watch is broken,
+// e.g. the revision is compacted or etcd is unreachable, the cache is synced again and the
+// watch restarts from its revision.
+func (r *Registry) run(ctx context.Context) {
+	for {
+		r.watch(ctx)
+
+		select {
+		case <-time.After(rewatchInterval):
+		case <-r.stop:
+			return
+		}
+
+		if err := r.sync(ctx); err != nil {
+			log.Printf("sync services failed: %v\n", err)
+		}
+	}
+}
+
+// watch applies the changes under prefix to the cache until the watch is broken.
+func (r *Registry) watch(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r.mtx.RLock()
+	revision := r.revision
+	r.mtx.RUnlock()
+
+	// Require leader, so the watch is broken instead of hanging if the member is partitioned.
+	changes := r.client.Watch(clientv3.WithRequireLeader(ctx), r.prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+	for resp := range changes {
+		if err := resp.Err(); err != nil {
+			log.Printf("watch services from revision %d failed: %v\n", revision+1, err)
+			return
+		}
+
+		r.apply(resp.Events, resp.Header.Revision)
+	}
+}
+
+// apply applies the events to the cache and notifies the watchers.
+func (r *Registry) apply(events []*clientv3.Event, revision int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, event := range events {
+		key := string(event.Kv.Key)
+
+		switch event.Type {
+		case mvccpb.PUT:
+			e, err := decode(event.Kv)
+			if err != nil {
+				log.Printf("failed to unmarshal registered service from %s: %v\n", key, err)
+				continue
+			}
+
+			_, exist := r.cache[key]
+			r.cache[key] = e
+			if !exist {
+				r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: e.service})
+			}
+		case mvccpb.DELETE:
+			if e, exist := r.cache[key]; exist {
+				delete(r.cache, key)
+				r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: e.service})
+			}
+		}
+	}
+
+	r.advance(revision)
+}
+
+// advance moves the revision of cache forward, the caller must hold the lock.
+func (r *Registry) advance(revision int64) {
+	if revision <= r.revision {
+		return
+	}
+
+	r.revision = revision
+	close(r.progress)
+	r.progress = make(chan struct{})
+}
+
+func decode(kv *mvccpb.KeyValue) (*entry, error) {
+	item := &Item{}
+	if err := json.Unmarshal(kv.Value, item); err != nil {
+		return nil, err
+	}
+	if item.Service == nil {
+		return nil, fmt.Errorf("no service in the value")
+	}
+
+	return &entry{service: item.Service, lease: clientv3.LeaseID(kv.Lease)}, nil
+}
+
+// wrap wraps the error of etcd with the matching error of registry, the other errors are
+// returned as is.
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var code codes.Code
+	if e, ok := err.(rpctypes.EtcdError); ok {
+		code = e.Code()
+	} else if s, ok := status.FromError(err); ok {
+		code = s.Code()
+	} else {
+		return err
+	}
+
+	switch code {
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return fmt.Errorf("%w: %v", registry.ErrForbidden, err)
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", registry.ErrTimeout, err)
+	case codes.Unavailable, codes.ResourceExhausted:
+		return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,499 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	regapi "github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// freeURL returns a local url with a free port.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen on a free port failed: %v", err)
+	}
+	defer l.Close()
+
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd starts an embedded etcd in process and returns its client, stop stops both of them.
+func startEtcd(t *testing.T) (client *clientv3.Client, stop func()) {
+	dir, err := ioutil.TempDir("", "etcd")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("start embedded etcd failed: %v", err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("embedded etcd is not ready in time")
+	}
+
+	client, err = clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.Host},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("create etcd client failed: %v", err)
+	}
+
+	return client, func() {
+		client.Close()
+		e.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// leaseOf returns the lease of service in the cache of registry.
+func leaseOf(t *testing.T, r *Registry, service *types.Service) clientv3.LeaseID {
+	key, err := r.key(service)
+	if err != nil {
+		t.Fatalf("get the key of service failed: %v", err)
+	}
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	e, exist := r.cache[key]
+	if !exist {
+		t.Fatalf("service %v is not in the cache", service)
+	}
+	return e.lease
+}
+
+func TestRegistery(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should get 1", len(services))
+	}
+
+	if !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the content of service changed after register")
+	}
+}
+
+func TestKeepRegisterService(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	lease := leaseOf(t, registry, service)
+
+	// The heartbeats keep the same lease alive.
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service again failed: %v", err)
+	}
+
+	key, err := registry.key(service)
+	if err != nil {
+		t.Fatalf("get the key of service failed: %v", err)
+	}
+	resp, err := client.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get the key of service failed: %v", err)
+	}
+	if len(resp.Kvs) != 1 || clientv3.LeaseID(resp.Kvs[0].Lease) != lease {
+		t.Fatalf("the key of service should be attached to lease %x", lease)
+	}
+
+	// Register after the lease is lost, a new lease is granted.
+	if _, err := client.Revoke(context.Background(), lease); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+	if _, err := client.KeepAliveOnce(context.Background(), lease); err != rpctypes.ErrLeaseNotFound {
+		t.Fatalf("keep alive revoked lease returns %v, should be %v", err, rpctypes.ErrLeaseNotFound)
+	}
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service after the lease is lost failed: %v", err)
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should be 1 after registering again", len(services))
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Expire the lease at once instead of waiting for the ttl.
+	if _, err := client.Revoke(context.Background(), leaseOf(t, registry, service)); err != nil {
+		t.Fatalf("revoke lease failed: %v", err)
+	}
+
+	for _, expected := range []regapi.EventType{regapi.Added, regapi.Removed} {
+		select {
+		case event := <-events:
+			if event.Type != expected || !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, expected, service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the event %v is not received in time", expected)
+		}
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after expired", len(services))
+	}
+}
+
+func TestDeregisterService(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	lease := leaseOf(t, registry, service)
+
+	if err := registry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after deregister", len(services))
+	}
+
+	// The lease of service is revoked rather than left to expire.
+	resp, err := client.TimeToLive(context.Background(), lease)
+	if err != nil {
+		t.Fatalf("get the ttl of lease failed: %v", err)
+	}
+	if resp.TTL != -1 {
+		t.Fatalf("the ttl of lease is %d after deregister, should be -1", resp.TTL)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	first, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer first.Close()
+
+	second, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer second.Close()
+
+	events, err := second.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Name:     "foo",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// The service registered to one replica is seen by the other.
+	if err := first.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != regapi.Added || !reflect.DeepEqual(service, event.Service) {
+			t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, regapi.Added, service)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the added service is not received in time")
+	}
+
+	services, err := second.ListServices(context.Background(), regapi.WithName("foo"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the listed services are %v, should be [%v]", services, service)
+	}
+}
+
+func TestSyncAfterCompaction(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	removed := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := registry.Register(context.Background(), removed); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	if event := <-events; event.Type != regapi.Added {
+		t.Fatalf("the type of event is %v, should be %v", event.Type, regapi.Added)
+	}
+
+	// Stop watching, then change the services and compact the revisions, as if the registry
+	// was disconnected for a long time.
+	registry.cancel()
+	registry.wg.Wait()
+
+	added := &types.Service{
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+	}
+	addedKey, err := registry.key(added)
+	if err != nil {
+		t.Fatalf("get the key of service failed: %v", err)
+	}
+	removedKey, err := registry.key(removed)
+	if err != nil {
+		t.Fatalf("get the key of service failed: %v", err)
+	}
+
+	if _, err := client.Put(context.Background(), addedKey, `{"service":{"address":"localhost","port":8081,"endpoint":"/webhook"}}`); err != nil {
+		t.Fatalf("put service failed: %v", err)
+	}
+	resp, err := client.Delete(context.Background(), removedKey)
+	if err != nil {
+		t.Fatalf("delete service failed: %v", err)
+	}
+	if _, err := client.Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	// Watch from the compacted revision, the watch is broken and the cache is synced.
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.cancel = cancel
+	registry.wg.Add(1)
+	go func() {
+		defer registry.wg.Done()
+		registry.run(ctx)
+	}()
+
+	received := make(map[regapi.EventType]*types.Service)
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received[event.Type] = event.Service
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the events are not received in time after compaction")
+		}
+	}
+
+	if !reflect.DeepEqual(received[regapi.Added], added) || !reflect.DeepEqual(received[regapi.Removed], removed) {
+		t.Fatalf("the added and removed services are %v and %v, should be %v and %v",
+			received[regapi.Added], received[regapi.Removed], added, removed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after the registry is closed")
+	}
+
+	// The client passed in is not closed with registry.
+	if _, err := client.Get(context.Background(), "foo"); err != nil {
+		t.Fatalf("get with the client after the registry is closed failed: %v", err)
+	}
+
+	// Close is idempotent.
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry again failed: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(ctx, service); err != context.Canceled {
+		t.Fatalf("register service with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+
+	if _, err := registry.ListServices(ctx); err != context.Canceled {
+		t.Fatalf("list services with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+}
+
+func TestWaitRevisionTimeout(t *testing.T) {
+	client, stop := startEtcd(t)
+	defer stop()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The revision is never reached.
+	if err := registry.waitRevision(ctx, math.MaxInt64); !errors.Is(err, regapi.ErrTimeout) {
+		t.Fatalf("wait for unreachable revision returns %v, should be %v", err, regapi.ErrTimeout)
+	}
+}
@@ -0,0 +1,80 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+type options struct {
+	// Endpoints of the etcd cluster, default is "127.0.0.1:2379".
+	endpoints   []string
+	dialTimeout time.Duration
+	tls         *tls.Config
+	username    string
+	password    string
+
+	// Prefix of the keys of services, default is "/kr/services/".
+	prefix string
+
+	// The lease of each registered service is granted with ttl, so it's deleted by etcd if it's
+	// not registered again in ttl.
+	ttl time.Duration
+}
+
+type Option func(*options)
+
+func WithEndpoints(endpoints ...string) Option {
+	return func(o *options) {
+		o.endpoints = endpoints
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithTLS connects to etcd over TLS with the config, it could carry the client certificate.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithAuth authenticates to etcd with the username and password.
+func WithAuth(username, password string) Option {
+	return func(o *options) {
+		o.username = username
+		o.password = password
+	}
+}
+
+// WithPrefix changes the prefix of keys, so multiple registries could be isolated in the same
+// etcd cluster.
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		endpoints:   []string{"127.0.0.1:2379"},
+		dialTimeout: 5 * time.Second,
+		prefix:      "/kr/services/",
+		ttl:         60 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
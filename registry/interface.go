@@ -1,10 +1,113 @@
 package registry
 
 import (
+	"context"
+
+	"k8s.io/apimachinery/pkg/labels"
+
 	"github.com/YaoZengzeng/kr/types"
 )
 
+// Registry stores the registered services. The ctx bounds the call, the backends give up and
+// return its error once it's done.
 type Registry interface {
-	Register(*types.Service) error
-	ListServices() ([]*types.Service, error)
+	Register(ctx context.Context, service *types.Service) error
+	Deregister(ctx context.Context, service *types.Service) error
+	ListServices(ctx context.Context, opts ...ListOption) ([]*types.Service, error)
+}
+
+// Elector is implemented by the registries whose replicas elect a leader to do the cleanup.
+type Elector interface {
+	// Identity returns the identity of this replica.
+	Identity() string
+	// Leader returns the identity of the current leader, empty if it's unknown.
+	Leader() string
+}
+
+// ListOptions filters the services returned by ListServices.
+type ListOptions struct {
+	// Only list the instances of the service with the name, empty means all services.
+	Name string
+	// Only list the instance with the ID, address, port or endpoint, empty or 0 means all.
+	ID       string
+	Address  string
+	Port     int
+	Endpoint string
+	// Only list the services whose metadata matches the selector, nil means all services.
+	Selector labels.Selector
+}
+
+type ListOption func(*ListOptions)
+
+func WithName(name string) ListOption {
+	return func(o *ListOptions) {
+		o.Name = name
+	}
+}
+
+// WithSelector matches the metadata of services by the selector. It's matched client-side by all
+// the backends, so the metadata values which are not label values are never a problem for them,
+// e.g. "version" matches the services having the key whatever its value is.
+func WithSelector(selector labels.Selector) ListOption {
+	return func(o *ListOptions) {
+		o.Selector = selector
+	}
+}
+
+func WithID(id string) ListOption {
+	return func(o *ListOptions) {
+		o.ID = id
+	}
+}
+
+func WithAddress(address string) ListOption {
+	return func(o *ListOptions) {
+		o.Address = address
+	}
+}
+
+func WithPort(port int) ListOption {
+	return func(o *ListOptions) {
+		o.Port = port
+	}
+}
+
+func WithEndpoint(endpoint string) ListOption {
+	return func(o *ListOptions) {
+		o.Endpoint = endpoint
+	}
+}
+
+// Matches checks whether the service satisfies the options.
+func (o *ListOptions) Matches(service *types.Service) bool {
+	if o.Name != "" && o.Name != service.Name {
+		return false
+	}
+	if o.ID != "" && o.ID != service.ID {
+		return false
+	}
+	if o.Address != "" && o.Address != service.Address {
+		return false
+	}
+	if o.Port != 0 && o.Port != service.Port {
+		return false
+	}
+	if o.Endpoint != "" && o.Endpoint != service.Endpoint {
+		return false
+	}
+
+	if o.Selector != nil && !o.Selector.Matches(labels.Set(service.Metadata)) {
+		return false
+	}
+
+	return true
+}
+
+// NewListOptions applies the opts to the default ListOptions.
+func NewListOptions(opts ...ListOption) *ListOptions {
+	o := &ListOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
 }
@@ -0,0 +1,34 @@
+// Package apicall bounds the API calls of Kubernetes by a context, it's shared by the Kubernetes
+// backends. The client-go we depend on doesn't take a context, so the call runs in a goroutine
+// and is abandoned once the context is done.
+package apicall
+
+import (
+	"context"
+)
+
+// Do calls fn and returns its error, or the error of ctx if ctx is done first. The abandoned fn
+// keeps running in the background until the request returns or times out by the rest config, its
+// results must not be used then.
+//
+// The error of ctx doesn't mean the call is not applied: an abandoned write may still succeed on
+// the API server. The callers must not treat it as definitely not applied, e.g. retrying a create
+// must accept AlreadyExists of its own object, and the watchers may see the write anyway.
+func Do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Buffered, so the abandoned fn doesn't block forever.
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
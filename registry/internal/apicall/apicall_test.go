@@ -0,0 +1,52 @@
+package apicall
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	expected := fmt.Errorf("not found")
+	if err := Do(context.Background(), func() error { return expected }); err != expected {
+		t.Fatalf("the error of call is %v, should be %v", err, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	if err := Do(ctx, func() error { called = true; return nil }); err != context.Canceled || called {
+		t.Fatalf("call with cancelled context returns %v and called %v, should be %v and not called", err, called, context.Canceled)
+	}
+}
+
+func TestCancelMidCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The call blocks until it's released, like a request to an unresponsive API server.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Do(ctx, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("the cancelled call returns %v, should be %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the call doesn't return after ctx is cancelled")
+	}
+}
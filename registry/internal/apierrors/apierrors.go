@@ -0,0 +1,30 @@
+// Package apierrors translates the API errors of Kubernetes to the errors of registry, it's
+// shared by the Kubernetes backends.
+package apierrors
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/YaoZengzeng/kr/registry"
+)
+
+// Wrap wraps the API error with the matching error of registry, the other errors are returned
+// as is.
+func Wrap(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.IsConflict(err) || errors.IsAlreadyExists(err):
+		return fmt.Errorf("%w: %v", registry.ErrConflict, err)
+	case errors.IsForbidden(err):
+		return fmt.Errorf("%w: %v", registry.ErrForbidden, err)
+	case errors.IsTimeout(err) || errors.IsServerTimeout(err):
+		return fmt.Errorf("%w: %v", registry.ErrTimeout, err)
+	case errors.IsServiceUnavailable(err) || errors.IsTooManyRequests(err) || errors.IsInternalError(err):
+		return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,43 @@
+package apierrors
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/YaoZengzeng/kr/registry"
+)
+
+func TestWrap(t *testing.T) {
+	resource := schema.GroupResource{Resource: "endpoints"}
+
+	cases := []struct {
+		err      error
+		expected error
+	}{
+		{apierrors.NewConflict(resource, "service", fmt.Errorf("the object has been modified")), registry.ErrConflict},
+		{apierrors.NewAlreadyExists(resource, "service"), registry.ErrConflict},
+		{apierrors.NewForbidden(resource, "service", fmt.Errorf("rbac")), registry.ErrForbidden},
+		{apierrors.NewServerTimeout(resource, "create", 1), registry.ErrTimeout},
+		{apierrors.NewServiceUnavailable("etcd is down"), registry.ErrUnavailable},
+		{apierrors.NewTooManyRequests("slow down", 1), registry.ErrUnavailable},
+	}
+
+	for _, c := range cases {
+		if err := Wrap(c.err); !errors.Is(err, c.expected) {
+			t.Fatalf("the wrapped error of %v is %v, should be %v", c.err, err, c.expected)
+		}
+	}
+
+	err := apierrors.NewNotFound(resource, "service")
+	if wrapped := Wrap(err); wrapped != err {
+		t.Fatalf("the wrapped error of %v is %v, should be itself", err, wrapped)
+	}
+
+	if Wrap(nil) != nil {
+		t.Fatalf("the wrapped error of nil should be nil")
+	}
+}
@@ -0,0 +1,192 @@
+// Package expiry tracks the deadlines of the registered services by name, it's shared by the
+// Kubernetes backends and the memory registry to notify the watchers of the expired services. Only the
+// changed deadline is touched on a heartbeat, the next one to pass is kept on top of a heap.
+package expiry
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+type entry struct {
+	name     string
+	service  *types.Service
+	deadline time.Time
+	// The index in the heap, -1 once the service has expired.
+	index int
+}
+
+// entries is a min-heap of the entries by deadline.
+type entries []*entry
+
+func (h entries) Len() int           { return len(h) }
+func (h entries) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h entries) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entries) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entries) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// Tracker calls expired once the deadline of a service passes, and revived if the deadline of
+// the expired service is extended later. The callbacks are called with the lock of tracker held,
+// so they must not block or call the tracker.
+type Tracker struct {
+	clock   clock.Clock
+	expired func(service *types.Service)
+	revived func(service *types.Service)
+
+	mtx    sync.Mutex
+	byName map[string]*entry
+	heap   entries
+	// resync wakes up Run when the deadlines change.
+	resync chan struct{}
+}
+
+func NewTracker(clock clock.Clock, expired, revived func(service *types.Service)) *Tracker {
+	return &Tracker{
+		clock:   clock,
+		expired: expired,
+		revived: revived,
+		byName:  make(map[string]*entry),
+		resync:  make(chan struct{}, 1),
+	}
+}
+
+// Track starts tracking the service with the name, or replaces its deadline if it's tracked.
+func (t *Tracker) Track(name string, service *types.Service, deadline time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if e, ok := t.byName[name]; ok {
+		e.service = service
+		t.extend(e, deadline)
+		return
+	}
+
+	e := &entry{name: name, service: service, deadline: deadline}
+	t.byName[name] = e
+	heap.Push(&t.heap, e)
+	t.wake()
+}
+
+// Extend replaces the deadline of the service with the name, it's a no-op if the name is not
+// tracked.
+func (t *Tracker) Extend(name string, deadline time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if e, ok := t.byName[name]; ok {
+		t.extend(e, deadline)
+	}
+}
+
+func (t *Tracker) extend(e *entry, deadline time.Time) {
+	e.deadline = deadline
+	switch {
+	case e.index >= 0:
+		heap.Fix(&t.heap, e.index)
+	case !deadline.Before(t.clock.Now()):
+		heap.Push(&t.heap, e)
+		t.revived(e.service)
+	default:
+		// Still expired, nothing to wake up for.
+		return
+	}
+	t.wake()
+}
+
+// Forget stops tracking the service with the name, it returns whether the service has expired
+// already, then it has been notified.
+func (t *Tracker) Forget(name string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	e, ok := t.byName[name]
+	if !ok {
+		return false
+	}
+
+	delete(t.byName, name)
+	if e.index < 0 {
+		return true
+	}
+
+	heap.Remove(&t.heap, e.index)
+	return false
+}
+
+func (t *Tracker) wake() {
+	select {
+	case t.resync <- struct{}{}:
+	default:
+	}
+}
+
+// Run notifies the services as their deadlines pass until stop is closed.
+func (t *Tracker) Run(stop <-chan struct{}) {
+	for {
+		var timer clock.Timer
+		var next <-chan time.Time
+		if d := t.check(); d > 0 {
+			timer = t.clock.NewTimer(d)
+			next = timer.C()
+		}
+
+		stopped := false
+		select {
+		case <-next:
+		case <-t.resync:
+		case <-stop:
+			stopped = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// check notifies the services whose deadlines have passed as expired, it returns the duration
+// until the next deadline passes, 0 if none.
+func (t *Tracker) check() time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.clock.Now()
+	for len(t.heap) > 0 {
+		e := t.heap[0]
+		if !e.deadline.Before(now) {
+			// Check again right after it passes.
+			return e.deadline.Sub(now) + time.Nanosecond
+		}
+
+		heap.Pop(&t.heap)
+		t.expired(e.service)
+	}
+
+	return 0
+}
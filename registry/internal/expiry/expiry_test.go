@@ -0,0 +1,78 @@
+package expiry
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+func TestTracker(t *testing.T) {
+	start := time.Now()
+	fakeClock := clock.NewFakeClock(start)
+
+	events := make(chan string, 10)
+	tracker := NewTracker(fakeClock,
+		func(service *types.Service) { events <- "expired " + service.Name },
+		func(service *types.Service) { events <- "revived " + service.Name },
+	)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go tracker.Run(stop)
+
+	expectEvent := func(expected string) {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Fatalf("the event is %q, should be %q", event, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the event %q is not received in time", expected)
+		}
+	}
+	expectNoEvent := func() {
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected event %q", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	// step waits for Run to wait for the next deadline, then moves the clock to it.
+	step := func(d time.Duration) {
+		for i := 0; i < 50 && !fakeClock.HasWaiters(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fakeClock.SetTime(start.Add(d))
+	}
+
+	tracker.Track("a", &types.Service{Name: "a"}, start.Add(10*time.Second))
+	tracker.Track("b", &types.Service{Name: "b"}, start.Add(20*time.Second))
+
+	step(11 * time.Second)
+	expectEvent("expired a")
+	expectNoEvent()
+
+	// The heartbeat of the expired service revives it.
+	tracker.Extend("a", start.Add(30*time.Second))
+	expectEvent("revived a")
+
+	// The forgotten service never expires.
+	if tracker.Forget("b") {
+		t.Fatalf("the service b is forgotten before expired, should not be notified")
+	}
+	step(21 * time.Second)
+	expectNoEvent()
+
+	// Extending the name not tracked is a no-op.
+	tracker.Extend("c", start.Add(40*time.Second))
+
+	step(31 * time.Second)
+	expectEvent("expired a")
+	if !tracker.Forget("a") {
+		t.Fatalf("the service a is forgotten after expired, should be notified")
+	}
+	expectNoEvent()
+}
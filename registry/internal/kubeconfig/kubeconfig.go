@@ -0,0 +1,108 @@
+// Package kubeconfig holds the options shared by the Kubernetes backends, where to find the
+// cluster and the namespace, ttl and cleanup period of the registered services in it.
+package kubeconfig
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+)
+
+// RequestTimeout bounds each request to the API server, except the watches of the informers.
+const RequestTimeout = 30 * time.Second
+
+type Options struct {
+	// Path of kubeconfig and the context in it, use in-cluster config if both are empty.
+	Kubeconfig string
+	Context    string
+
+	// The namespace to store the registered services, default is "default".
+	Namespace string
+
+	TTL     time.Duration
+	Cleanup time.Duration
+}
+
+// NewOptions returns the default options, the backends apply their own options on it.
+func NewOptions() Options {
+	return Options{
+		Namespace: apiv1.NamespaceDefault,
+		TTL:       60 * time.Second,
+		Cleanup:   10 * time.Minute,
+	}
+}
+
+// RestConfig loads the config to connect to the cluster. The kubeconfig is loaded by the default
+// rules ($KUBECONFIG or ~/.kube/config) if only the context is specified. Each request is bounded
+// by RequestTimeout, so the calls abandoned by their context don't pile up.
+func (o *Options) RestConfig() (*rest.Config, error) {
+	config, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not config.Timeout, it's the timeout of the http client, which cuts the watches of the
+	// informers too and makes them relist every time.
+	config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return &timeoutRoundTripper{rt: rt, timeout: RequestTimeout}
+	})
+
+	return config, nil
+}
+
+func (o *Options) load() (*rest.Config, error) {
+	if o.Kubeconfig == "" && o.Context == "" {
+		return rest.InClusterConfig()
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.Kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: o.Context,
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// timeoutRoundTripper bounds the requests by timeout, including reading the response body. The
+// watches are long running, they're left to the server to close.
+type timeoutRoundTripper struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Query().Get("watch") == "true" || strings.Contains(req.URL.Path, "/watch/") {
+		return t.rt.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the timer of the request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,56 @@
+package kubeconfig
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutRoundTripper(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reply the headers, then hang on the body as a watch does.
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: &timeoutRoundTripper{rt: http.DefaultTransport, timeout: 100 * time.Millisecond}}
+
+	// The request is bounded by the timeout, including reading the body.
+	resp, err := client.Get(ts.URL + "/api/v1/namespaces/default/endpoints/service-0")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	_, err = resp.Body.Read(make([]byte, 1))
+	resp.Body.Close()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read the body of a hanging request returns %v, should be %v", err, context.DeadlineExceeded)
+	}
+
+	// The watch is not bounded.
+	resp, err = client.Get(ts.URL + "/api/v1/namespaces/default/endpoints?watch=true")
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := resp.Body.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("the watch should not time out: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,263 @@
+// Package leases keeps the heartbeats of the registered services in Leases, it's shared by the
+// Kubernetes backends. A lease either belongs to one service, or is shared by the services
+// stored in the same object, then the renew time of each holder is kept in its annotation.
+package leases
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	coordinationlisterv1 "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/apicall"
+)
+
+// The renew times of the holders of a shared lease.
+var holdersKey = "holders"
+
+// Client renews and deletes the leases labelled with labels, the leases with the same name but
+// other labels are never touched.
+type Client struct {
+	client coordinationclientv1.LeaseInterface
+	lister coordinationlisterv1.LeaseNamespaceLister
+	labels labels.Set
+	ttl    time.Duration
+	clock  clock.Clock
+}
+
+func NewClient(client coordinationclientv1.LeaseInterface, lister coordinationlisterv1.LeaseNamespaceLister,
+	labels labels.Set, ttl time.Duration, clock clock.Clock) *Client {
+	return &Client{
+		client: client,
+		lister: lister,
+		labels: labels,
+		ttl:    ttl,
+		clock:  clock,
+	}
+}
+
+// Holders returns the renew times of the holders of the shared lease.
+func Holders(lease *coordinationv1.Lease) map[string]time.Time {
+	holders := make(map[string]time.Time)
+	if value, ok := lease.Annotations[holdersKey]; ok {
+		if err := json.Unmarshal([]byte(value), &holders); err != nil {
+			return make(map[string]time.Time)
+		}
+	}
+	return holders
+}
+
+// Deadline returns when the holder of lease expires, false if it never renews the lease. The
+// holder is empty if the lease is not shared.
+func Deadline(lease *coordinationv1.Lease, holder string) (time.Time, bool) {
+	if lease.Spec.LeaseDurationSeconds == nil {
+		return time.Time{}, false
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+
+	if holder != "" {
+		renewTime, ok := Holders(lease)[holder]
+		return renewTime.Add(duration), ok
+	}
+
+	if lease.Spec.RenewTime == nil {
+		return time.Time{}, false
+	}
+	return lease.Spec.RenewTime.Add(duration), true
+}
+
+// ExpiresAt returns when the holder of the lease with the name expires by the cache, or fallback
+// if it never renews the lease.
+func (c *Client) ExpiresAt(name, holder string, fallback time.Time) time.Time {
+	lease, err := c.lister.Get(name)
+	if err != nil {
+		return fallback
+	}
+
+	if deadline, ok := Deadline(lease, holder); ok {
+		return deadline
+	}
+	return fallback
+}
+
+// get gets the lease with the name from cache, or from the API server if fresh.
+func (c *Client) get(ctx context.Context, name string, fresh bool) (*coordinationv1.Lease, error) {
+	if !fresh {
+		return c.lister.Get(name)
+	}
+
+	var lease *coordinationv1.Lease
+	err := apicall.Do(ctx, func() (err error) {
+		lease, err = c.client.Get(name, metav1.GetOptions{})
+		return err
+	})
+	return lease, err
+}
+
+// Renew renews the lease with the name for the holder, the lease is created if it doesn't exist.
+// Multiple replicas of registry may renew the same lease, so the conflicts are retried with the
+// latest lease.
+func (c *Client) Renew(ctx context.Context, name, holder string) error {
+	fresh := false
+	retriable := func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}
+
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		// The error of ctx is not retriable, so the retries stop once it's done.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		now := c.clock.Now()
+		renewTime := metav1.NewMicroTime(now)
+		duration := int32(math.Ceil(c.ttl.Seconds()))
+
+		// The cache may be stale, get the latest lease when retrying.
+		lease, err := c.get(ctx, name, fresh)
+		fresh = true
+
+		if errors.IsNotFound(err) {
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: labels.Merge(c.labels, nil),
+				},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &name,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &renewTime,
+					RenewTime:            &renewTime,
+				},
+			}
+			if holder != "" {
+				if err := setHolders(lease, map[string]time.Time{holder: now}); err != nil {
+					return err
+				}
+			}
+			return apicall.Do(ctx, func() error {
+				_, err := c.client.Create(lease)
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+		if !c.labels.AsSelector().Matches(labels.Set(lease.Labels)) {
+			return fmt.Errorf("%w: lease %s is not created by registry", registry.ErrConflict, name)
+		}
+
+		// If we have multiple instances of registry, it's possible that have leases renewed later than now.
+		var holders map[string]time.Time
+		if holder != "" {
+			holders = Holders(lease)
+			if renewed, ok := holders[holder]; ok && !now.After(renewed) {
+				return nil
+			}
+		} else if lease.Spec.RenewTime != nil && !now.After(lease.Spec.RenewTime.Time) {
+			return nil
+		}
+
+		// Never modify the object in cache.
+		lease = lease.DeepCopy()
+		if lease.Spec.RenewTime == nil || now.After(lease.Spec.RenewTime.Time) {
+			lease.Spec.RenewTime = &renewTime
+		}
+		lease.Spec.LeaseDurationSeconds = &duration
+		if holder != "" {
+			holders[holder] = now
+			if err := setHolders(lease, holders); err != nil {
+				return err
+			}
+		}
+		return apicall.Do(ctx, func() error {
+			_, err := c.client.Update(lease)
+			return err
+		})
+	})
+}
+
+// Release removes the holders from the shared lease with the name, the lease is deleted once no
+// holder is left. Releasing the lease which doesn't exist is not an error.
+func (c *Client) Release(ctx context.Context, name string, holders ...string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Always get the latest lease, the holders renewed lately must be kept.
+		lease, err := c.get(ctx, name, true)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !c.labels.AsSelector().Matches(labels.Set(lease.Labels)) {
+			return nil
+		}
+
+		renewed := Holders(lease)
+		released := false
+		for _, holder := range holders {
+			if _, ok := renewed[holder]; ok {
+				delete(renewed, holder)
+				released = true
+			}
+		}
+		if !released {
+			return nil
+		}
+
+		if len(renewed) == 0 {
+			return c.Delete(ctx, name, lease.ResourceVersion)
+		}
+
+		lease = lease.DeepCopy()
+		if err := setHolders(lease, renewed); err != nil {
+			return err
+		}
+		return apicall.Do(ctx, func() error {
+			_, err := c.client.Update(lease)
+			return err
+		})
+	})
+}
+
+// Delete deletes the lease with the name. If resourceVersion is not empty, the lease is only
+// deleted if it's not changed since then, otherwise the deletion fails with conflict.
+func (c *Client) Delete(ctx context.Context, name string, resourceVersion string) error {
+	options := &metav1.DeleteOptions{}
+	if resourceVersion != "" {
+		options.Preconditions = &metav1.Preconditions{ResourceVersion: &resourceVersion}
+	}
+
+	err := apicall.Do(ctx, func() error {
+		return c.client.Delete(name, options)
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func setHolders(lease *coordinationv1.Lease, holders map[string]time.Time) error {
+	value, err := json.Marshal(holders)
+	if err != nil {
+		return err
+	}
+
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string)
+	}
+	lease.Annotations[holdersKey] = string(value)
+	return nil
+}
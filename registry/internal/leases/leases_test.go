@@ -0,0 +1,99 @@
+package leases
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	coordinationlisterv1 "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/YaoZengzeng/kr/registry"
+)
+
+// newTestClient returns the client with an empty cache, so every lease is got from the fake
+// clientset after the first attempt.
+func newTestClient(clientset *fake.Clientset, clock clock.Clock) *Client {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lister := coordinationlisterv1.NewLeaseLister(indexer).Leases("default")
+
+	return NewClient(clientset.CoordinationV1().Leases("default"), lister, labels.Set{"registered": "true"}, 60*time.Second, clock)
+}
+
+func TestSharedLease(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	start := time.Now()
+	fakeClock := clock.NewFakeClock(start)
+	client := newTestClient(clientset, fakeClock)
+
+	for _, holder := range []string{"a", "b"} {
+		if err := client.Renew(context.Background(), "service-0", holder); err != nil {
+			t.Fatalf("renew lease failed: %v", err)
+		}
+		fakeClock.Step(time.Second)
+	}
+
+	lease, err := clientset.CoordinationV1().Leases("default").Get("service-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease directly failed: %v", err)
+	}
+
+	// Each holder expires by its own renew time.
+	for holder, renewTime := range map[string]time.Time{"a": start, "b": start.Add(time.Second)} {
+		deadline, ok := Deadline(lease, holder)
+		if !ok || !deadline.Equal(renewTime.Add(60*time.Second)) {
+			t.Fatalf("the deadline of holder %s is %v, should be %v", holder, deadline, renewTime.Add(60*time.Second))
+		}
+	}
+	if _, ok := Deadline(lease, "c"); ok {
+		t.Fatalf("the holder c never renews the lease, should have no deadline")
+	}
+
+	if err := client.Release(context.Background(), "service-0", "a"); err != nil {
+		t.Fatalf("release lease failed: %v", err)
+	}
+
+	lease, err = clientset.CoordinationV1().Leases("default").Get("service-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease directly failed: %v", err)
+	}
+	if holders := Holders(lease); len(holders) != 1 {
+		t.Fatalf("the holders of lease are %v, should be only b", holders)
+	}
+
+	// The lease is deleted with its last holder.
+	if err := client.Release(context.Background(), "service-0", "b"); err != nil {
+		t.Fatalf("release lease failed: %v", err)
+	}
+
+	if _, err := clientset.CoordinationV1().Leases("default").Get("service-0", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("the lease should be deleted after all holders released: %v", err)
+	}
+}
+
+func TestLeaseNotOwned(t *testing.T) {
+	// The lease with the same name is not created by registry.
+	clientset := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "service-0", Namespace: "default"},
+	})
+	client := newTestClient(clientset, clock.RealClock{})
+
+	if err := client.Renew(context.Background(), "service-0", ""); !errors.Is(err, registry.ErrConflict) {
+		t.Fatalf("renew the lease not created by registry returns %v, should be %v", err, registry.ErrConflict)
+	}
+
+	lease, err := clientset.CoordinationV1().Leases("default").Get("service-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease directly failed: %v", err)
+	}
+	if lease.Spec.RenewTime != nil {
+		t.Fatalf("the lease not created by registry should not be renewed")
+	}
+}
@@ -1,32 +1,50 @@
 package kubernetes
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
-	// "k8s.io/apimachinery/pkg/api/errors"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	coordinationlisterv1 "k8s.io/client-go/listers/coordination/v1"
 	corelisterv1 "k8s.io/client-go/listers/core/v1"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
-
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/apicall"
+	"github.com/YaoZengzeng/kr/registry/internal/apierrors"
+	"github.com/YaoZengzeng/kr/registry/internal/expiry"
+	"github.com/YaoZengzeng/kr/registry/internal/leases"
 	"github.com/YaoZengzeng/kr/types"
 )
 
+// The defaults of the name prefix and label key, they could be changed by options.
 var (
 	nameprefix = "service"
 
 	labelKey   = "registered-service-filter"
 	labelValue = "true"
 
+	// The name of service is stored in the label, so we could list the instances of a service efficiently.
+	nameLabelKey = "registered-service-name"
+
 	annotationKey = "service-content"
 )
 
@@ -34,16 +52,52 @@ type Registry struct {
 	client corev1.EndpointsInterface
 	lister corelisterv1.EndpointsNamespaceLister
 
+	nameprefix string
+	labelKey   string
+
+	// If createService is true, a Service named after each registered name is created with the
+	// instances of the name as its endpoints, so they're routable through cluster DNS. The
+	// Services are synced from the informers through queue.
+	createService bool
+	services      corev1.ServiceInterface
+	queue         workqueue.RateLimitingInterface
+
+	// Each registered service has a lease with the same name as its endpoint, the heartbeats
+	// renew the lease and the ttl is its lease duration.
+	leases      *leases.Client
+	leaseLister coordinationlisterv1.LeaseNamespaceLister
+
 	// Time To Live for a service, default is 60 * time.Second.
-	ttl time.Duration
+	ttl   time.Duration
+	clock clock.Clock
 	// If the service expired, we would not clean it up immediately,
 	// otherwise we would every cleanup period in batch (10 * time.Minute in default).
 	cleanup time.Duration
+
+	// Only the leader cleans up the expired services if elector is not nil.
+	elector  *leaderelection.LeaderElector
+	identity string
+	// leaderMtx guards isLeader and leader, and orders the start of the cleanup of the leader
+	// with Close.
+	leaderMtx sync.Mutex
+	isLeader  bool
+	leader    string
+
+	broadcaster *registry.Broadcaster
+	// expiry tracks the deadlines of the endpoints by the heartbeats on their leases, so the
+	// expired services are notified before they are cleaned up.
+	expiry *expiry.Tracker
+
+	// stop is closed by Close to stop the informers and the cleanup, cancel stops the leader
+	// election, and wg waits for the goroutines of registry to exit.
+	stop      chan struct{}
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
-func NewRegistry() (*Registry, error) {
-	// Only support in-cluster config.
-	config, err := rest.InClusterConfig()
+func NewRegistry(opts ...Option) (*Registry, error) {
+	config, err := newOptions(opts...).RestConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -53,83 +107,184 @@ func NewRegistry() (*Registry, error) {
 		return nil, err
 	}
 
-	return newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	return newRegistry(clientset, 60*time.Second, 10*time.Minute, opts...)
 }
 
-// Easy for test: take fake.NewSimpleClientset() as input.
-func newRegistry(clientset kubernetes.Interface, ttl time.Duration, cleanup time.Duration) (*Registry, error) {
-	informers := informers.NewSharedInformerFactory(clientset, 0)
+// newRegistry takes the clientset of the endpoints, leases and Services, so the tests run it on
+// fake.NewSimpleClientset() with a short ttl. The ttl and cleanup could be overridden by opts.
+func newRegistry(clientset kubernetes.Interface, ttl time.Duration, cleanup time.Duration, opts ...Option) (*Registry, error) {
+	o := newOptions(append([]Option{WithTTL(ttl), WithCleanup(cleanup)}, opts...)...)
 
-	endpointInformer := informers.Core().V1().Endpoints().Informer()
+	// Only watch the endpoints created by registry in the namespace.
+	informers := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(o.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.Set{o.labelKey: labelValue}.String()
+		}),
+	)
 
-	stop := make(chan struct{})
-	informers.Start(stop)
+	endpointInformer := informers.Core().V1().Endpoints().Informer()
+	leaseInformer := informers.Coordination().V1().Leases().Informer()
 
-	if !cache.WaitForCacheSync(stop, endpointInformer.HasSynced) {
-		return nil, fmt.Errorf("failed to wait endpoint informer synced")
+	registry := &Registry{
+		client:        clientset.CoreV1().Endpoints(o.Namespace),
+		lister:        informers.Core().V1().Endpoints().Lister().Endpoints(o.Namespace),
+		nameprefix:    o.nameprefix,
+		labelKey:      o.labelKey,
+		createService: o.createService,
+		services:      clientset.CoreV1().Services(o.Namespace),
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "services"),
+		leaseLister:   informers.Coordination().V1().Leases().Lister().Leases(o.Namespace),
+		ttl:           o.TTL,
+		clock:         o.clock,
+		cleanup:       o.Cleanup,
+		broadcaster:   registry.NewBroadcaster(),
+		stop:          make(chan struct{}),
+	}
+	registry.leases = leases.NewClient(clientset.CoordinationV1().Leases(o.Namespace), registry.leaseLister,
+		labels.Set{o.labelKey: labelValue}, o.TTL, o.clock)
+	registry.expiry = expiry.NewTracker(o.clock, registry.onExpired, registry.onRevived)
+
+	endpointInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    registry.onAdd,
+		UpdateFunc: registry.onUpdate,
+		DeleteFunc: registry.onDelete,
+	})
+	// The leases are renewed without touching the endpoints, so watch them to tell whether the
+	// expired services heartbeat again.
+	leaseInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    registry.onLease,
+		UpdateFunc: func(_, newObj interface{}) { registry.onLease(newObj) },
+	})
+
+	informers.Start(registry.stop)
+
+	if !cache.WaitForCacheSync(registry.stop, endpointInformer.HasSynced, leaseInformer.HasSynced) {
+		registry.Close()
+		return nil, fmt.Errorf("failed to wait endpoint and lease informers synced")
 	}
 
-	registry := &Registry{
-		client: clientset.CoreV1().Endpoints(apiv1.NamespaceDefault),
-		// Only operate endpoints in default namespace.
-		lister:  informers.Core().V1().Endpoints().Lister().Endpoints(apiv1.NamespaceDefault),
-		ttl:     ttl,
-		cleanup: cleanup,
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.cancel = cancel
+
+	registry.wg.Add(1)
+	go func() {
+		defer registry.wg.Done()
+		registry.expiry.Run(registry.stop)
+	}()
+
+	if registry.createService {
+		registry.wg.Add(1)
+		go func() {
+			defer registry.wg.Done()
+			registry.runServiceSync(ctx)
+		}()
 	}
 
-	go registry.Cleanup()
+	registry.wg.Add(1)
+	if o.leaderElection {
+		elector, err := registry.newLeaderElector(clientset, o)
+		if err != nil {
+			registry.wg.Done()
+			registry.Close()
+			return nil, err
+		}
+		registry.elector = elector
+		go func() {
+			defer registry.wg.Done()
+			registry.runLeaderElection(ctx)
+		}()
+	} else {
+		go func() {
+			defer registry.wg.Done()
+			registry.Cleanup()
+		}()
+	}
 
 	return registry, nil
 }
 
+// Close stops the informers, the cleanup and the leader election of registry, the leader
+// releases its lease so another replica takes over right away. The registered services are
+// kept, they belong to the clients. The channels of watchers are closed after that.
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		if r.cancel != nil {
+			r.cancel()
+		}
+		// The cleanup of the leader checks stop before joining wg.
+		r.leaderMtx.Lock()
+		close(r.stop)
+		r.leaderMtx.Unlock()
+		r.queue.ShutDown()
+		r.wg.Wait()
+		r.broadcaster.Close()
+	})
+
+	return nil
+}
+
 type Item struct {
 	Service *types.Service `json:"service"`
-	Update  time.Time      `json:"update"`
+	// Update is the time the endpoint was written. It was the heartbeat of the old version
+	// of registry, now the heartbeats renew the lease instead.
+	Update time.Time `json:"update"`
 }
 
-func (r *Registry) Register(service *types.Service) error {
+// nameOf returns the name of endpoint for the service, it's the name of its lease too.
+func (r *Registry) nameOf(service *types.Service) (string, error) {
 	b, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s-%x", r.nameprefix, scopeOf(r.labelKey), md5.Sum(b)), nil
+}
+
+// scopeOf returns the part of the object names telling the registries with different label keys
+// apart, so they never write the objects of each other in the same namespace. It's empty for the
+// default label key to keep the names of the objects created before.
+func scopeOf(key string) string {
+	if key == labelKey {
+		return ""
+	}
+
+	return fmt.Sprintf("-%x", md5.Sum([]byte(key)))[:9]
+}
+
+// Register creates or renews the service, every API call returns once ctx is done.
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	return apierrors.Wrap(r.register(ctx, service))
+}
+
+func (r *Registry) register(ctx context.Context, service *types.Service) error {
+	// The Service is named after the name of service.
+	if r.createService && service.Name != "" {
+		if err := validateServiceName(service.Name); err != nil {
+			return err
+		}
+	}
+
+	name, err := r.nameOf(service)
 	if err != nil {
 		return err
 	}
 
 	exist := true
-	name := fmt.Sprintf("%s-%x", nameprefix, md5.Sum(b))
-	result, err := r.lister.Get(name)
-	if err != nil {
+	if _, err := r.lister.Get(name); err != nil {
 		// If we failed to get endpoint from cache, just assume it doesn't exist.
 		exist = false
 	}
 
-	now := time.Now()
-
 	if exist {
-		value := result.Annotations[annotationKey]
-		oldItem := &Item{}
-		// TODO: handle this error properly.
-		if err := json.Unmarshal([]byte(value), oldItem); err != nil {
+		if err := r.updateSubsets(ctx, name, service); err != nil {
 			return err
 		}
-		// If we have multiple instances of registry, it's possible that have items newer than now.
-		// Only update the endpoint if we could set the Update field newer.
-		if now.After(oldItem.Update) {
-			oldItem.Update = now
-			value, err := json.Marshal(oldItem)
-			if err != nil {
-				return err
-			}
-
-			result.Annotations[annotationKey] = string(value)
-			// TODO: handle this error properly.
-			if _, err := r.client.Update(result); err != nil {
-				return err
-			}
-		}
 	} else {
 		// For simplicity, don't consider the disorder of network packets.
 		item := &Item{
 			Service: service,
-			Update:  now,
+			Update:  r.clock.Now(),
 		}
 		value, err := json.Marshal(item)
 		if err != nil {
@@ -140,37 +295,103 @@ func (r *Registry) Register(service *types.Service) error {
 			ObjectMeta: metav1.ObjectMeta{
 				Name: name,
 				Labels: map[string]string{
-					labelKey: labelValue,
+					r.labelKey:   labelValue,
+					nameLabelKey: service.Name,
 				},
 				Annotations: map[string]string{
 					annotationKey: string(value),
 				},
 			},
+			Subsets: subsetsOf(service),
 		}
-		// TODO: handle this error properly.
-		if _, err := r.client.Create(endpoint); err != nil {
+
+		// The endpoint may be created by another replica of registry just now, then it's a heartbeat.
+		err = apicall.Do(ctx, func() error {
+			_, err := r.client.Create(endpoint)
+			return err
+		})
+		if errors.IsAlreadyExists(err) {
+			err = r.checkOwned(ctx, name)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
+	// Heartbeats only renew the lease, so the endpoint and its watchers are not disturbed.
+	return r.leases.Renew(ctx, name, "")
+}
+
+// checkOwned checks whether the existing endpoint with the name is created by registry, it fails
+// with registry.ErrConflict if not, so the endpoint and its lease are left alone.
+func (r *Registry) checkOwned(ctx context.Context, name string) error {
+	var endpoint *apiv1.Endpoints
+	err := apicall.Do(ctx, func() (err error) {
+		endpoint, err = r.client.Get(name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if endpoint.Labels[r.labelKey] != labelValue {
+		return fmt.Errorf("%w: endpoint %s is not created by registry with label %s", registry.ErrConflict, name, r.labelKey)
+	}
+
 	return nil
 }
 
+// Deregister deletes the endpoint of the service right away instead of waiting for it to expire.
+// Deregistering a service which doesn't exist is not an error.
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	return apierrors.Wrap(r.deregister(ctx, service))
+}
+
+func (r *Registry) deregister(ctx context.Context, service *types.Service) error {
+	name, err := r.nameOf(service)
+	if err != nil {
+		return err
+	}
+
+	foregroundDelete := metav1.DeletePropagationForeground
+	err = apicall.Do(ctx, func() error {
+		return r.client.Delete(name, &metav1.DeleteOptions{PropagationPolicy: &foregroundDelete})
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return r.leases.Delete(ctx, name, "")
+}
+
 // Cleanup try to clean up the expired service in best effort. It's OK if we don't clean up in time
 // or clean up incorrectly. If the servcie keep register, mistakes will always be corrected.
+// It returns after the registry is closed.
 func (r *Registry) Cleanup() {
+	r.runCleanup(context.Background())
+}
+
+// runCleanup cleans up the expired services every cleanup period until ctx is done or the
+// registry is closed.
+func (r *Registry) runCleanup(ctx context.Context) {
 	ticker := time.NewTicker(r.cleanup)
+	defer ticker.Stop()
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		}
 
-		endpoints, err := r.lister.List(labels.SelectorFromSet(labels.Set{labelKey: labelValue}))
+		endpoints, err := r.lister.List(labels.SelectorFromSet(labels.Set{r.labelKey: labelValue}))
 		if err != nil {
 			log.Printf("list endpoints failed in Cleanup(): %v", err)
 		}
 
-		now := time.Now()
+		now := r.clock.Now()
 
-		var names []string
 		for _, endpoint := range endpoints {
 			value := endpoint.Annotations[annotationKey]
 			item := &Item{}
@@ -180,30 +401,108 @@ func (r *Registry) Cleanup() {
 				continue
 			}
 
-			if item.Update.Add(r.ttl).Before(now) {
+			if r.expired(endpoint.Name, item, now) {
 				// The registered service has expired, clean it up.
-				names = append(names, endpoint.Name)
+				if err := r.deleteExpired(ctx, endpoint.Name); err != nil {
+					log.Printf("failed to clean up expired service %v: %v\n", endpoint.Name, err)
+				}
 			}
 		}
+	}
+}
 
-		foregroundDelete := metav1.DeletePropagationForeground
-		for _, name := range names {
-			err := r.client.Delete(name, &metav1.DeleteOptions{PropagationPolicy: &foregroundDelete})
-			// TODO: handle this error properly.
-			if err != nil {
-				log.Printf("failed to delete endpoint %v\n", name)
-			}
+// deleteExpired deletes the expired service with the name. The lease is deleted first with the
+// resource version we have seen, if another replica of registry renews it in the meantime, the
+// deletion fails with conflict and the service is kept.
+func (r *Registry) deleteExpired(ctx context.Context, name string) error {
+	if lease, err := r.leaseLister.Get(name); err == nil {
+		err := r.leases.Delete(ctx, name, lease.ResourceVersion)
+		if errors.IsConflict(err) {
+			return nil
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	foregroundDelete := metav1.DeletePropagationForeground
+	err := apicall.Do(ctx, func() error {
+		return r.client.Delete(name, &metav1.DeleteOptions{PropagationPolicy: &foregroundDelete})
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
 	}
+
+	return nil
 }
 
-func (r *Registry) ListServices() ([]*types.Service, error) {
-	endpoints, err := r.lister.List(labels.SelectorFromSet(labels.Set{labelKey: labelValue}))
+// updateSubsets updates the subsets of the endpoint with the name if they are out of date, the
+// update is retried with the latest endpoint on conflicts.
+func (r *Registry) updateSubsets(ctx context.Context, name string, service *types.Service) error {
+	// The content of service never changes because the name is the hash of it, only the
+	// endpoints created by the old version of registry have no subsets.
+	subsets := subsetsOf(service)
+
+	fresh := false
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The cache may be stale, get the latest endpoint when retrying.
+		var endpoint *apiv1.Endpoints
+		var err error
+		if fresh {
+			err = apicall.Do(ctx, func() (err error) {
+				endpoint, err = r.client.Get(name, metav1.GetOptions{})
+				return err
+			})
+		} else {
+			endpoint, err = r.lister.Get(name)
+		}
+		fresh = true
+		if err != nil {
+			return err
+		}
+
+		if reflect.DeepEqual(endpoint.Subsets, subsets) {
+			return nil
+		}
+
+		// Never modify the object in cache.
+		endpoint = endpoint.DeepCopy()
+		endpoint.Subsets = subsets
+		return apicall.Do(ctx, func() error {
+			_, err := r.client.Update(endpoint)
+			return err
+		})
+	})
+}
+
+// ListServices lists the services from the cache, ctx is only checked before listing.
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	set := labels.Set{r.labelKey: labelValue}
+	if options.Name != "" {
+		// The name is the value of nameLabelKey on the endpoints, SelectorFromSet would silently
+		// drop an invalid one and list the endpoints of all the names.
+		if errs := validation.IsValidLabelValue(options.Name); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid service name %q: %s", options.Name, strings.Join(errs, "; "))
+		}
+		set[nameLabelKey] = options.Name
+	}
+
+	endpoints, err := r.lister.List(labels.SelectorFromSet(set))
 	if err != nil {
 		return nil, err
 	}
 
-	now := time.Now()
+	now := r.clock.Now()
 
 	res := make([]*types.Service, 0, len(endpoints))
 	for _, endpoint := range endpoints {
@@ -215,13 +514,94 @@ func (r *Registry) ListServices() ([]*types.Service, error) {
 			continue
 		}
 
-		if item.Update.Add(r.ttl).Before(now) {
+		if r.expired(endpoint.Name, item, now) {
 			// The registered service has expired, skip.
 			continue
 		}
 
+		// The name has been filtered by label, but the metadata is only stored in the annotation.
+		if !options.Matches(item.Service) {
+			continue
+		}
+
 		res = append(res, item.Service)
 	}
 
 	return res, nil
 }
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// itemOf returns the name of endpoint and the item stored in it, or nil if the endpoint is not
+// created by registry.
+func (r *Registry) itemOf(obj interface{}) (string, *Item) {
+	endpoint, ok := obj.(*apiv1.Endpoints)
+	if !ok {
+		return "", nil
+	}
+
+	if endpoint.Labels[r.labelKey] != labelValue {
+		return "", nil
+	}
+
+	item := &Item{}
+	if err := json.Unmarshal([]byte(endpoint.Annotations[annotationKey]), item); err != nil {
+		log.Printf("failed to unmarshal registered service from %v\n", endpoint.Name)
+		return "", nil
+	}
+
+	return endpoint.Name, item
+}
+
+// serviceOf returns the registered service stored in the endpoint, or nil if the endpoint
+// is not created by registry.
+func (r *Registry) serviceOf(obj interface{}) *types.Service {
+	if _, item := r.itemOf(obj); item != nil {
+		return item.Service
+	}
+	return nil
+}
+
+func (r *Registry) onAdd(obj interface{}) {
+	if name, item := r.itemOf(obj); item != nil {
+		r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: item.Service})
+		r.expiry.Track(name, item.Service, r.expiresAt(name, item))
+		r.enqueueService(item.Service)
+	}
+}
+
+func (r *Registry) onUpdate(oldObj, newObj interface{}) {
+	oldService, newService := r.serviceOf(oldObj), r.serviceOf(newObj)
+	if newService == nil {
+		return
+	}
+
+	// Heartbeats only bump the update time of the item, don't notify them.
+	if oldService != nil && reflect.DeepEqual(oldService, newService) {
+		return
+	}
+
+	r.broadcaster.Notify(registry.Event{Type: registry.Updated, Service: newService})
+}
+
+func (r *Registry) onDelete(obj interface{}) {
+	// The object may be a tombstone if the watch missed the deletion.
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	service := r.serviceOf(obj)
+	if service == nil {
+		return
+	}
+	r.enqueueService(service)
+
+	// The expired service has been notified as removed already.
+	if r.expiry.Forget(obj.(*apiv1.Endpoints).Name) {
+		return
+	}
+
+	r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+}
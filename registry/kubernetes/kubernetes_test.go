@@ -2,13 +2,29 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 
+	regapi "github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
@@ -26,7 +42,7 @@ func TestRegistery(t *testing.T) {
 		Endpoint: "/webhook",
 	}
 
-	err = registry.Register(service)
+	err = registry.Register(context.Background(), service)
 	if err != nil {
 		t.Fatalf("register service failed: %v", err)
 	}
@@ -34,7 +50,7 @@ func TestRegistery(t *testing.T) {
 	// Need to wait for the local cache to be populated.
 	time.Sleep(100 * time.Millisecond)
 
-	services, err := registry.ListServices()
+	services, err := registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -63,7 +79,7 @@ func TestServiceExpire(t *testing.T) {
 		Endpoint: "/webhook",
 	}
 
-	err = registry.Register(service)
+	err = registry.Register(context.Background(), service)
 	if err != nil {
 		t.Fatalf("register service failed: %v", err)
 	}
@@ -71,7 +87,7 @@ func TestServiceExpire(t *testing.T) {
 	// Need to wait for the local cache to be populated.
 	time.Sleep(100 * time.Millisecond)
 
-	services, err := registry.ListServices()
+	services, err := registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -82,7 +98,7 @@ func TestServiceExpire(t *testing.T) {
 
 	time.Sleep(5 * time.Second)
 
-	services, err = registry.ListServices()
+	services, err = registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -91,7 +107,7 @@ func TestServiceExpire(t *testing.T) {
 		t.Fatalf("the number of listed services is %d, should get 0, because it should be expired", len(services))
 	}
 
-	err = registry.Register(service)
+	err = registry.Register(context.Background(), service)
 	if err != nil {
 		t.Fatalf("register service again failed: %v", err)
 	}
@@ -99,7 +115,7 @@ func TestServiceExpire(t *testing.T) {
 	// Also need to wait for the local cache to be populated.
 	time.Sleep(100 * time.Millisecond)
 
-	services, err = registry.ListServices()
+	services, err = registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -139,7 +155,7 @@ func TestKeepRegisterSerivce(t *testing.T) {
 		for {
 			select {
 			case <-ticker.C:
-				err := registry.Register(service)
+				err := registry.Register(context.Background(), service)
 				if err != nil {
 					t.Fatalf("register service failed: %v", err)
 				}
@@ -158,7 +174,7 @@ func TestKeepRegisterSerivce(t *testing.T) {
 	for {
 		select {
 		case <-ticker.C:
-			services, err := registry.ListServices()
+			services, err := registry.ListServices(context.Background())
 			if err != nil {
 				t.Fatalf("list services failed: %v", err)
 			}
@@ -200,7 +216,7 @@ func TestRegisterModifiedService(t *testing.T) {
 	}
 
 	for _, service := range services {
-		err = registry.Register(service)
+		err = registry.Register(context.Background(), service)
 		if err != nil {
 			t.Fatalf("register service failed: %v", err)
 		}
@@ -209,7 +225,7 @@ func TestRegisterModifiedService(t *testing.T) {
 	// Need to wait for the local cache to be populated.
 	time.Sleep(100 * time.Millisecond)
 
-	registeredServices, err := registry.ListServices()
+	registeredServices, err := registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -246,7 +262,7 @@ func TestServiceCleanup(t *testing.T) {
 		Endpoint: "/webhook",
 	}
 
-	err = registry.Register(service)
+	err = registry.Register(context.Background(), service)
 	if err != nil {
 		t.Fatalf("register service failed: %v", err)
 	}
@@ -254,7 +270,7 @@ func TestServiceCleanup(t *testing.T) {
 	// Need to wait for the local cache to be populated.
 	time.Sleep(100 * time.Millisecond)
 
-	services, err := registry.ListServices()
+	services, err := registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -275,3 +291,941 @@ func TestServiceCleanup(t *testing.T) {
 		t.Fatalf("the number of underlying endpoints is %d, should get 0, because it get expired and cleanup", len(endpoints))
 	}
 }
+
+func TestDeregisterService(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Deregister same service multiple times to test idempotency.
+	for i := 0; i < 2; i++ {
+		if err := registry.Deregister(context.Background(), service); err != nil {
+			t.Fatalf("deregister service failed: %v", err)
+		}
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should get 0 after deregisteration", len(services))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := registry.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	err = registry.Deregister(context.Background(), service)
+	if err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	for _, expected := range []regapi.EventType{regapi.Added, regapi.Removed} {
+		select {
+		case event := <-events:
+			if event.Type != expected {
+				t.Fatalf("the type of event is %v, should be %v", event.Type, expected)
+			}
+			if !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the service of event is %v, should be %v", event.Service, service)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v event", expected)
+		}
+	}
+}
+
+func TestListServicesByName(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	services := []*types.Service{
+		{Name: "billing-webhook", ID: "0", Address: "localhost", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing-webhook", ID: "1", Address: "localhost", Port: 8081, Endpoint: "/webhook"},
+		{Name: "message", ID: "0", Address: "localhost", Port: 8082, Endpoint: "/message"},
+	}
+	for _, service := range services {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	listed, err := registry.ListServices(context.Background(), regapi.WithName("billing-webhook"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("the number of listed services is %d, should get 2", len(listed))
+	}
+
+	for _, s := range listed {
+		if s.Name != "billing-webhook" {
+			t.Fatalf("the name of listed service is %s, should be billing-webhook", s.Name)
+		}
+	}
+
+	if _, err := registry.ListServices(context.Background(), regapi.WithName("invalid name")); err == nil {
+		t.Fatalf("list services with invalid name should fail")
+	}
+}
+
+func TestListServicesBySelector(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	services := []*types.Service{
+		{Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"version": "v1", "zone": "a"}},
+		{Address: "localhost", Port: 8081, Endpoint: "/webhook", Metadata: map[string]string{"version": "v2", "zone": "a"}},
+	}
+	for _, service := range services {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	selector, err := labels.Parse("zone=a,version in (v2, v3)")
+	if err != nil {
+		t.Fatalf("parse selector failed: %v", err)
+	}
+
+	listed, err := registry.ListServices(context.Background(), regapi.WithSelector(selector))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	// The metadata should be persisted in the annotation.
+	if len(listed) != 1 || !reflect.DeepEqual(services[1], listed[0]) {
+		t.Fatalf("the listed services are %v, should get %v", listed, services[1])
+	}
+}
+
+func TestMetadataNotLabelValue(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	// The value is too long and has spaces, it can't be a label value.
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1", "description": strings.Repeat("a", 100) + " / beta"},
+	}
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, s := range []string{"version=v1", "description", "version=v1,description"} {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			t.Fatalf("parse selector failed: %v", err)
+		}
+
+		listed, err := registry.ListServices(context.Background(), regapi.WithSelector(selector))
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		// The metadata is kept as is, and matched client-side.
+		if len(listed) != 1 || !reflect.DeepEqual(service, listed[0]) {
+			t.Fatalf("the listed services by %q are %v, should get %v", s, listed, service)
+		}
+	}
+}
+
+func TestRegisterWithService(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute, WithService())
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	instances := []*types.Service{
+		{Name: "billing", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing", Address: "10.0.0.2", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing", Address: "10.0.0.2", Port: 9090, Endpoint: "/webhook"},
+		{Name: "audit", Address: "webhook.example.com", Port: 8080, Endpoint: "/webhook"},
+	}
+
+	for _, instance := range instances {
+		if err := registry.Register(context.Background(), instance); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// The endpoint of each instance is populated.
+	name, err := registry.nameOf(instances[0])
+	if err != nil {
+		t.Fatalf("get name of service failed: %v", err)
+	}
+	endpoint, err := clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get endpoint failed: %v", err)
+	}
+	if len(endpoint.Subsets) != 1 || endpoint.Subsets[0].Addresses[0].IP != instances[0].Address {
+		t.Fatalf("the subsets of endpoint are %v, should be the address %v", endpoint.Subsets, instances[0].Address)
+	}
+
+	// expectEndpoints waits for the Endpoints of the Service to have the addresses of each port.
+	expectEndpoints := func(name string, expected map[int32][]string) {
+		err := wait.PollImmediate(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+			endpoints, err := clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{})
+			if err != nil {
+				return false, nil
+			}
+
+			addresses := make(map[int32][]string)
+			for _, subset := range endpoints.Subsets {
+				for _, address := range subset.Addresses {
+					addresses[subset.Ports[0].Port] = append(addresses[subset.Ports[0].Port], address.IP)
+				}
+			}
+			return reflect.DeepEqual(addresses, expected), nil
+		})
+		if err != nil {
+			t.Fatalf("the Endpoints of Service %s don't have the addresses %v", name, expected)
+		}
+	}
+
+	// One selector-less Service for all the instances of billing.
+	expectEndpoints("billing", map[int32][]string{8080: {"10.0.0.1", "10.0.0.2"}, 9090: {"10.0.0.2"}})
+
+	s, err := clientset.CoreV1().Services(apiv1.NamespaceDefault).Get("billing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get service failed: %v", err)
+	}
+	if s.Spec.Type != "" || len(s.Spec.Selector) != 0 || len(s.Spec.Ports) != 2 {
+		t.Fatalf("the spec of Service billing is %v, should be selector-less with 2 ports", s.Spec)
+	}
+
+	// The instance with hostname gets an ExternalName Service.
+	err = wait.PollImmediate(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+		s, err := clientset.CoreV1().Services(apiv1.NamespaceDefault).Get("audit", metav1.GetOptions{})
+		return err == nil && s.Spec.Type == apiv1.ServiceTypeExternalName && s.Spec.ExternalName == instances[3].Address, nil
+	})
+	if err != nil {
+		t.Fatalf("the ExternalName Service audit is not created")
+	}
+
+	// Deregistering an instance removes it from the endpoints, the Service is deleted with the
+	// last instance.
+	if err := registry.Deregister(context.Background(), instances[0]); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+	expectEndpoints("billing", map[int32][]string{8080: {"10.0.0.2"}, 9090: {"10.0.0.2"}})
+
+	for _, instance := range instances[1:] {
+		if err := registry.Deregister(context.Background(), instance); err != nil {
+			t.Fatalf("deregister service failed: %v", err)
+		}
+	}
+
+	for _, name := range []string{"billing", "audit"} {
+		err = wait.PollImmediate(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+			_, err := clientset.CoreV1().Services(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{})
+			return apierrors.IsNotFound(err), nil
+		})
+		if err != nil {
+			t.Fatalf("the Service %s should be deleted after deregisteration", name)
+		}
+	}
+
+	// The name of Service must be a DNS-1035 label.
+	invalid := &types.Service{Name: "Billing.v1", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"}
+	if err := registry.Register(context.Background(), invalid); err == nil {
+		t.Fatalf("register service with name %q should fail", invalid.Name)
+	}
+}
+
+func TestServiceNotOwned(t *testing.T) {
+	// The Service with the same name is created by the user.
+	clientset := fake.NewSimpleClientset(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "billing", Namespace: apiv1.NamespaceDefault},
+		Spec:       apiv1.ServiceSpec{Selector: map[string]string{"app": "billing"}},
+	})
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute, WithService())
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{Name: "billing", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"}
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	if err := registry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	// Wait for the syncs of Service.
+	time.Sleep(500 * time.Millisecond)
+
+	s, err := clientset.CoreV1().Services(apiv1.NamespaceDefault).Get("billing", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("the Service not created by registry should be kept: %v", err)
+	}
+	if !reflect.DeepEqual(s.Spec.Selector, map[string]string{"app": "billing"}) {
+		t.Fatalf("the Service not created by registry is changed to %v", s.Spec)
+	}
+}
+
+func TestIsolatedRegistries(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	// The registries share the namespace and the name prefix, only the label keys differ.
+	defaultRegistry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute, WithLeaderElection("default-0"))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer defaultRegistry.Close()
+
+	teamRegistry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute, WithLabelKey("team-a-service"), WithLeaderElection("team-a-0"))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer teamRegistry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	for _, registry := range []*Registry{defaultRegistry, teamRegistry} {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	endpoints, err := clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoints directly failed: %v", err)
+	}
+
+	if len(endpoints.Items) != 2 {
+		t.Fatalf("the number of underlying endpoints is %d, should get 2, one for each registry", len(endpoints.Items))
+	}
+
+	for _, registry := range []*Registry{defaultRegistry, teamRegistry} {
+		services, err := registry.ListServices(context.Background())
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+			t.Fatalf("the listed services of registry with label %s are %v, should get [%v]", registry.labelKey, services, service)
+		}
+	}
+
+	// Deregistering from one registry leaves the other alone.
+	if err := teamRegistry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	services, err := defaultRegistry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services in default registry is %d, should get 1", len(services))
+	}
+
+	// Each registry leads its own cleanup.
+	err = wait.PollImmediate(100*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return defaultRegistry.Leader() == "default-0" && teamRegistry.Leader() == "team-a-0", nil
+	})
+	if err != nil {
+		t.Fatalf("the leaders are %q and %q, should be the registries themselves", defaultRegistry.Leader(), teamRegistry.Leader())
+	}
+}
+
+func TestEndpointNotOwned(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	name, err := registry.nameOf(service)
+	if err != nil {
+		t.Fatalf("get the name of endpoint failed: %v", err)
+	}
+
+	// The endpoint with the same name is not created by registry.
+	_, err = clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).Create(&apiv1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+	})
+	if err != nil {
+		t.Fatalf("create endpoint directly failed: %v", err)
+	}
+
+	if err := registry.Register(context.Background(), service); !errors.Is(err, regapi.ErrConflict) {
+		t.Fatalf("register service over the endpoint not created by registry returns %v, should be %v", err, regapi.ErrConflict)
+	}
+
+	if _, err := clientset.CoordinationV1().Leases(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("the lease of the endpoint not created by registry should not be created: %v", err)
+	}
+}
+
+func TestRestConfigFromKubeconfig(t *testing.T) {
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: admin
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+current-context: dev
+users:
+- name: admin
+  user:
+    token: secret
+`
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatalf("create kubeconfig failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(kubeconfig); err != nil {
+		t.Fatalf("write kubeconfig failed: %v", err)
+	}
+	f.Close()
+
+	cases := []struct {
+		opts []Option
+		host string
+	}{
+		{[]Option{WithKubeconfig(f.Name())}, "https://dev.example.com:6443"},
+		{[]Option{WithKubeconfig(f.Name()), WithContext("prod")}, "https://prod.example.com:6443"},
+	}
+
+	for _, c := range cases {
+		config, err := newOptions(c.opts...).RestConfig()
+		if err != nil {
+			t.Fatalf("build rest config failed: %v", err)
+		}
+
+		if config.Host != c.host {
+			t.Fatalf("the host of rest config is %s, should be %s", config.Host, c.host)
+		}
+	}
+}
+
+func TestHeartbeatRenewsLease(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 3*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	clientset.ClearActions()
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service again failed: %v", err)
+	}
+
+	leaseUpdates := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "update" && action.GetVerb() != "create" {
+			continue
+		}
+
+		switch action.GetResource().Resource {
+		case "endpoints":
+			t.Fatalf("heartbeat should not write endpoint, got action %v", action)
+		case "leases":
+			leaseUpdates++
+		}
+	}
+
+	if leaseUpdates != 1 {
+		t.Fatalf("the number of lease updates is %d, should be 1", leaseUpdates)
+	}
+
+	name, err := registry.nameOf(service)
+	if err != nil {
+		t.Fatalf("get name of service failed: %v", err)
+	}
+
+	lease, err := clientset.CoordinationV1().Leases(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease failed: %v", err)
+	}
+
+	if lease.Spec.LeaseDurationSeconds == nil || *lease.Spec.LeaseDurationSeconds != 3 {
+		t.Fatalf("the lease duration is %v, should be 3 seconds", lease.Spec.LeaseDurationSeconds)
+	}
+
+	err = registry.Deregister(context.Background(), service)
+	if err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	if _, err := clientset.CoordinationV1().Leases(apiv1.NamespaceDefault).Get(name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("the lease should be deleted after deregisteration, got error %v", err)
+	}
+}
+
+func TestConcurrentReplicas(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	// Multiple replicas of registry share the same cluster.
+	var replicas []*Registry
+	for i := 0; i < 3; i++ {
+		registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+		if err != nil {
+			t.Fatalf("create new registry failed: %v", err)
+		}
+		replicas = append(replicas, registry)
+	}
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// The same service registers to all the replicas at the same time, the caches of them
+	// are stale, so the creations race with each other.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(replicas)*5)
+	for _, registry := range replicas {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(registry *Registry) {
+				defer wg.Done()
+				if err := registry.Register(context.Background(), service); err != nil {
+					errs <- err
+				}
+			}(registry)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("register service to replica failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, registry := range replicas {
+		services, err := registry.ListServices(context.Background())
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+			t.Fatalf("the listed services are %v, should get %v", services, service)
+		}
+	}
+}
+
+func TestRegisterRetryOnConflict(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Need to wait for the local cache to be populated.
+	time.Sleep(100 * time.Millisecond)
+
+	// Simulate another replica renewing the lease between our read and write.
+	conflicts := 2
+	clientset.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease)
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service should succeed after retrying conflicts: %v", err)
+	}
+
+	if conflicts != 0 {
+		t.Fatalf("the update of lease should be retried on conflicts")
+	}
+}
+
+func TestLeaderElectedCleanup(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	var replicas []*Registry
+	for _, identity := range []string{"replica-0", "replica-1"} {
+		registry, err := newRegistry(clientset, 1*time.Second, 1*time.Second, WithLeaderElection(identity))
+		if err != nil {
+			t.Fatalf("create new registry failed: %v", err)
+		}
+		replicas = append(replicas, registry)
+	}
+
+	// Wait for the leader to be elected.
+	var leader string
+	for i := 0; i < 50 && leader == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+		leader = replicas[0].Leader()
+	}
+
+	if leader == "" {
+		t.Fatalf("no leader is elected")
+	}
+
+	leaders := 0
+	for _, registry := range replicas {
+		if registry.Leader() != leader {
+			t.Fatalf("the leader of %s is %s, should be %s", registry.Identity(), registry.Leader(), leader)
+		}
+		if registry.Identity() == leader {
+			leaders++
+		}
+	}
+
+	if leaders != 1 {
+		t.Fatalf("the number of leaders is %d, should be 1", leaders)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err := replicas[0].Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Wait service to expire and be cleaned up by the leader.
+	time.Sleep(4 * time.Second)
+
+	endpoints, err := clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoints directly failed: %v", err)
+	}
+
+	if len(endpoints.Items) != 0 {
+		t.Fatalf("the number of underlying endpoints is %d, should get 0, because it get expired and cleanup", len(endpoints.Items))
+	}
+}
+
+func TestClose(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 1*time.Second, 1*time.Second, WithLeaderElection("replica-0"))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	// Wait for the leader to be elected.
+	for i := 0; i < 50 && registry.Leader() == ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if registry.Leader() != "replica-0" {
+		t.Fatalf("the leader is %q, should be replica-0", registry.Leader())
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after the registry is closed")
+	}
+
+	// The leader releases its lease when it's closed.
+	lease, err := clientset.CoordinationV1().Leases(apiv1.NamespaceDefault).Get("service-cleanup-leader", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get lease of leader election failed: %v", err)
+	}
+
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		t.Fatalf("the holder of lease is %q after close, should be empty", *lease.Spec.HolderIdentity)
+	}
+
+	// Close is idempotent.
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry again failed: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(ctx, service); err != context.Canceled {
+		t.Fatalf("register service with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+
+	endpoints, err := clientset.CoreV1().Endpoints(apiv1.NamespaceDefault).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list endpoints directly failed: %v", err)
+	}
+
+	if len(endpoints.Items) != 0 {
+		t.Fatalf("the number of underlying endpoints is %d, should be 0", len(endpoints.Items))
+	}
+}
+
+func TestCancelMidCall(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	// The creation blocks until it's released, like a request to an unresponsive API server.
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	clientset.PrependReactor("create", "endpoints", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		close(started)
+		<-release
+		return false, nil, nil
+	})
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- registry.Register(ctx, service)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("register service cancelled mid-call returns %v, should be %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("register service doesn't return after ctx is cancelled")
+	}
+}
+
+func TestLeaseExpiryEvents(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	registry, err := newRegistry(clientset, 60*time.Second, 10*time.Minute, WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "10.0.0.1",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	expectEvent := func(expected regapi.EventType) {
+		select {
+		case event := <-events:
+			if event.Type != expected || !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, expected, service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v event", expected)
+		}
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(regapi.Added)
+
+	// Wait for the check of expiry to wait for the lease, then let the lease expire. The endpoint
+	// is kept until the cleanup, but the service is removed for the watchers.
+	for i := 0; i < 50 && !fakeClock.HasWaiters(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	fakeClock.Step(61 * time.Second)
+	expectEvent(regapi.Removed)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after expired", len(services))
+	}
+
+	// The expired service heartbeats again before it's cleaned up, then it's added back.
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(regapi.Added)
+
+	// Deregistering notifies the service as removed once.
+	if err := registry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+	expectEvent(regapi.Removed)
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v %v after deregister", event.Type, event.Service)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,123 @@
+package kubernetes
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	// The durations of leader election, the same as the defaults of kube-controller-manager.
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// newLeaderElector creates the elector of the replicas of registry, only the leader cleans up
+// the expired services. The lock is a Lease named after the name prefix and the label key in the
+// namespace, so the registries isolated by label key elect their own leaders.
+func (r *Registry) newLeaderElector(clientset kubernetes.Interface, o *options) (*leaderelection.LeaderElector, error) {
+	identity := o.identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+	r.identity = identity
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      o.nameprefix + scopeOf(o.labelKey) + "-cleanup-leader",
+			Namespace: o.Namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lock.LeaseMeta.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: r.lead,
+			// It's called whenever Run returns, even if the leadership was never acquired.
+			OnStoppedLeading: func() {
+				r.leaderMtx.Lock()
+				defer r.leaderMtx.Unlock()
+				if r.isLeader {
+					r.isLeader = false
+					log.Printf("%s stopped leading the cleanup of registry\n", identity)
+				}
+			},
+			// GetLeader of the elector reads the record without lock, so track the leader here.
+			OnNewLeader: func(leader string) {
+				r.leaderMtx.Lock()
+				r.leader = leader
+				r.leaderMtx.Unlock()
+				log.Printf("%s is the leader of the cleanup of registry\n", leader)
+			},
+		},
+	})
+}
+
+// lead cleans up the expired services until ctx is cancelled, when the leadership is lost. The
+// elector runs it in a goroutine of its own, so it joins wg to be waited by Close, unless the
+// registry is closed already.
+func (r *Registry) lead(ctx context.Context) {
+	r.leaderMtx.Lock()
+	select {
+	case <-r.stop:
+		r.leaderMtx.Unlock()
+		return
+	default:
+	}
+	r.isLeader = true
+	r.wg.Add(1)
+	r.leaderMtx.Unlock()
+
+	defer r.wg.Done()
+	r.runCleanup(ctx)
+}
+
+// runLeaderElection keeps campaigning for the leader, because Run returns once the leadership is lost.
+func (r *Registry) runLeaderElection(ctx context.Context) {
+	for {
+		r.elector.Run(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// Identity returns the identity of this replica in leader election, empty if it's not enabled.
+func (r *Registry) Identity() string {
+	return r.identity
+}
+
+// Leader returns the identity of the replica which cleans up the expired services, empty if
+// leader election is not enabled or the leader is unknown yet.
+func (r *Registry) Leader() string {
+	if r.elector == nil {
+		return ""
+	}
+
+	r.leaderMtx.Lock()
+	defer r.leaderMtx.Unlock()
+	return r.leader
+}
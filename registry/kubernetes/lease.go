@@ -0,0 +1,49 @@
+package kubernetes
+
+import (
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/leases"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// expired checks whether the service in the endpoint with the name has expired.
+func (r *Registry) expired(name string, item *Item, now time.Time) bool {
+	return r.expiresAt(name, item).Before(now)
+}
+
+// expiresAt returns when the service in the endpoint with the name expires. The endpoints created
+// by the old version of registry may have no lease, then the update time of item is used.
+func (r *Registry) expiresAt(name string, item *Item) time.Time {
+	return r.leases.ExpiresAt(name, "", item.Update.Add(r.ttl))
+}
+
+// onLease extends the deadline of the service with the renewed lease, the expired service is
+// notified as added again. Only the lease changed is looked at, so a heartbeat costs the same
+// however many services are registered.
+func (r *Registry) onLease(obj interface{}) {
+	lease, ok := obj.(*coordinationv1.Lease)
+	if !ok {
+		return
+	}
+
+	if deadline, ok := leases.Deadline(lease, ""); ok {
+		r.expiry.Extend(lease.Name, deadline)
+	}
+}
+
+// onExpired notifies the expired service as removed. The endpoint is kept until the cleanup,
+// so the watchers are notified here rather than by its deletion.
+func (r *Registry) onExpired(service *types.Service) {
+	r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+	r.enqueueService(service)
+}
+
+// onRevived notifies the expired service which heartbeats again as added.
+func (r *Registry) onRevived(service *types.Service) {
+	r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+	r.enqueueService(service)
+}
@@ -0,0 +1,119 @@
+package kubernetes
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/YaoZengzeng/kr/registry/internal/kubeconfig"
+)
+
+type options struct {
+	kubeconfig.Options
+
+	// Prefix of the name of endpoints, default is "service".
+	nameprefix string
+	// Key of the label to filter the endpoints created by registry, default is "registered-service-filter".
+	labelKey string
+
+	createService bool
+
+	// Only the leader of replicas cleans up the expired services if leaderElection is true.
+	leaderElection bool
+	identity       string
+
+	// The clock to renew the leases and tell the expired services, default is the real clock.
+	clock clock.Clock
+}
+
+type Option func(*options)
+
+// WithKubeconfig makes registry connect to the cluster in the kubeconfig file, so it could run
+// out of cluster.
+func WithKubeconfig(kubeconfig string) Option {
+	return func(o *options) {
+		o.Kubeconfig = kubeconfig
+	}
+}
+
+// WithContext selects the context in kubeconfig, the kubeconfig is loaded by the default rules
+// ($KUBECONFIG or ~/.kube/config) if WithKubeconfig is not specified.
+func WithContext(context string) Option {
+	return func(o *options) {
+		o.Context = context
+	}
+}
+
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.Namespace = namespace
+	}
+}
+
+func WithNamePrefix(nameprefix string) Option {
+	return func(o *options) {
+		o.nameprefix = nameprefix
+	}
+}
+
+// WithLabelKey changes the key of label to filter endpoints, so multiple registries could be
+// isolated in the same namespace. The key is part of the names of the endpoints, the leases and
+// the lock of leader election too, so the same service registered to them never collides.
+func WithLabelKey(labelKey string) Option {
+	return func(o *options) {
+		o.labelKey = labelKey
+	}
+}
+
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.TTL = ttl
+	}
+}
+
+func WithCleanup(cleanup time.Duration) Option {
+	return func(o *options) {
+		o.Cleanup = cleanup
+	}
+}
+
+// WithService makes registry create a Service for each name of the registered services, with the
+// instances of the name as its endpoints. The name must be a DNS-1035 label then, the services
+// without name get no Service.
+func WithService() Option {
+	return func(o *options) {
+		o.createService = true
+	}
+}
+
+// WithLeaderElection makes the replicas of registry elect a leader to clean up the expired services,
+// identity is the unique identity of this replica, the hostname is used if it's empty.
+func WithLeaderElection(identity string) Option {
+	return func(o *options) {
+		o.leaderElection = true
+		o.identity = identity
+	}
+}
+
+// WithClock replaces the clock to renew the leases and tell the expired services, the tests step
+// clock.NewFakeClock() past the ttl instead of sleeping.
+func WithClock(clock clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		Options:    kubeconfig.NewOptions(),
+		nameprefix: nameprefix,
+		labelKey:   labelKey,
+		clock:      clock.RealClock{},
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
@@ -0,0 +1,360 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/YaoZengzeng/kr/registry/internal/apicall"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// The value of label key on the Services and their Endpoints created by registry, it differs from
+// labelValue so the Endpoints of Services are not taken as registered services.
+var serviceLabelValue = "service"
+
+// routableIP returns the IP of the service if it could be used as the address of endpoint,
+// otherwise nil. Kubernetes rejects the loopback, link-local and unspecified addresses.
+func routableIP(service *types.Service) net.IP {
+	ip := net.ParseIP(service.Address)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// subsetsOf returns the subsets of the endpoint for the service, so it's visible to kube-proxy
+// and DNS. The address of endpoint must be an IP, so the services registered with hostname
+// have no subsets.
+func subsetsOf(service *types.Service) []apiv1.EndpointSubset {
+	ip := routableIP(service)
+	if ip == nil {
+		return nil
+	}
+
+	return []apiv1.EndpointSubset{
+		{
+			Addresses: []apiv1.EndpointAddress{{IP: ip.String()}},
+			Ports: []apiv1.EndpointPort{
+				{
+					Port:     int32(service.Port),
+					Protocol: apiv1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// validateServiceName checks whether the name of service could be the name of its Service.
+func validateServiceName(name string) error {
+	if errs := validation.IsDNS1035Label(name); len(errs) != 0 {
+		return fmt.Errorf("service name %q is not a valid name of Service: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// portName names the port of Service and Endpoints, the ports must be named if there are more
+// than one.
+func portName(port int32) string {
+	return fmt.Sprintf("tcp-%d", port)
+}
+
+// serviceFor returns the Service with the name and the subsets of its Endpoints for the instances
+// registered with the name. The instances registered with IP are the endpoints of a selector-less
+// Service, grouped by port. If none of them is routable, the instance registered with hostname
+// gets an ExternalName Service, the first by address if there are more. Nil is returned if there
+// is no instance for a Service.
+func (r *Registry) serviceFor(name string, instances []*types.Service) (*apiv1.Service, []apiv1.EndpointSubset) {
+	s := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				r.labelKey:   serviceLabelValue,
+				nameLabelKey: name,
+			},
+		},
+	}
+
+	// The addresses of each port, the same address registered with different endpoints is
+	// only counted once.
+	addresses := make(map[int32]map[string]bool)
+	var hostnames []*types.Service
+	for _, instance := range instances {
+		ip := routableIP(instance)
+		if ip == nil {
+			if net.ParseIP(instance.Address) == nil {
+				hostnames = append(hostnames, instance)
+			}
+			continue
+		}
+
+		port := int32(instance.Port)
+		if addresses[port] == nil {
+			addresses[port] = make(map[string]bool)
+		}
+		addresses[port][ip.String()] = true
+	}
+
+	if len(addresses) == 0 {
+		if len(hostnames) == 0 {
+			return nil, nil
+		}
+
+		sort.Slice(hostnames, func(i, j int) bool {
+			return hostnames[i].Address < hostnames[j].Address
+		})
+		s.Spec.Type = apiv1.ServiceTypeExternalName
+		s.Spec.ExternalName = hostnames[0].Address
+		s.Spec.Ports = []apiv1.ServicePort{servicePort(int32(hostnames[0].Port))}
+		return s, nil
+	}
+
+	ports := make([]int32, 0, len(addresses))
+	for port := range addresses {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	subsets := make([]apiv1.EndpointSubset, 0, len(ports))
+	for _, port := range ports {
+		s.Spec.Ports = append(s.Spec.Ports, servicePort(port))
+
+		ips := make([]string, 0, len(addresses[port]))
+		for ip := range addresses[port] {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+
+		subset := apiv1.EndpointSubset{
+			Ports: []apiv1.EndpointPort{{Name: portName(port), Port: port, Protocol: apiv1.ProtocolTCP}},
+		}
+		for _, ip := range ips {
+			subset.Addresses = append(subset.Addresses, apiv1.EndpointAddress{IP: ip})
+		}
+		subsets = append(subsets, subset)
+	}
+
+	return s, subsets
+}
+
+func servicePort(port int32) apiv1.ServicePort {
+	return apiv1.ServicePort{
+		Name:       portName(port),
+		Port:       port,
+		TargetPort: intstr.FromInt(int(port)),
+		Protocol:   apiv1.ProtocolTCP,
+	}
+}
+
+// enqueueService queues the Service of the service to be synced, if the Services are enabled.
+func (r *Registry) enqueueService(service *types.Service) {
+	if r.createService && service.Name != "" {
+		r.queue.Add(service.Name)
+	}
+}
+
+// runServiceSync syncs the queued Services until the queue is shut down. The failed syncs are
+// queued again with backoff.
+func (r *Registry) runServiceSync(ctx context.Context) {
+	for {
+		key, quit := r.queue.Get()
+		if quit {
+			return
+		}
+
+		name := key.(string)
+		if err := r.syncService(ctx, name); err != nil {
+			log.Printf("sync Service %s failed: %v\n", name, err)
+			r.queue.AddRateLimited(key)
+		} else {
+			r.queue.Forget(key)
+		}
+		r.queue.Done(key)
+	}
+}
+
+// syncService makes the Service with the name and its Endpoints match the live instances
+// registered with the name, the Service is deleted if there is none.
+func (r *Registry) syncService(ctx context.Context, name string) error {
+	endpoints, err := r.lister.List(labels.SelectorFromSet(labels.Set{r.labelKey: labelValue, nameLabelKey: name}))
+	if err != nil {
+		return err
+	}
+
+	now := r.clock.Now()
+	instances := make([]*types.Service, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		item := &Item{}
+		if err := json.Unmarshal([]byte(endpoint.Annotations[annotationKey]), item); err != nil {
+			continue
+		}
+		if r.expired(endpoint.Name, item, now) {
+			continue
+		}
+		instances = append(instances, item.Service)
+	}
+
+	s, subsets := r.serviceFor(name, instances)
+	if s == nil {
+		return r.deleteService(ctx, name)
+	}
+
+	if err := r.applyService(ctx, s); err != nil {
+		return err
+	}
+
+	// The ExternalName Service has no endpoints.
+	if s.Spec.Type == apiv1.ServiceTypeExternalName {
+		return r.deleteEndpoints(ctx, name)
+	}
+
+	return r.applyEndpoints(ctx, name, s.Labels, subsets)
+}
+
+// applyService creates the Service or updates its spec. The Service with the same name not
+// created by registry is left alone.
+func (r *Registry) applyService(ctx context.Context, s *apiv1.Service) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var current *apiv1.Service
+		err := apicall.Do(ctx, func() (err error) {
+			current, err = r.services.Get(s.Name, metav1.GetOptions{})
+			return err
+		})
+		if errors.IsNotFound(err) {
+			return apicall.Do(ctx, func() error {
+				_, err := r.services.Create(s)
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		if current.Labels[r.labelKey] != serviceLabelValue {
+			return fmt.Errorf("Service %s is not created by registry", s.Name)
+		}
+
+		updated := current.DeepCopy()
+		updated.Spec.Type = s.Spec.Type
+		updated.Spec.ExternalName = s.Spec.ExternalName
+		updated.Spec.Ports = s.Spec.Ports
+		// The ExternalName Service has no cluster IP, it's allocated again if the type changes back.
+		if s.Spec.Type == apiv1.ServiceTypeExternalName {
+			updated.Spec.ClusterIP = ""
+		}
+		if reflect.DeepEqual(current.Spec, updated.Spec) {
+			return nil
+		}
+
+		return apicall.Do(ctx, func() error {
+			_, err := r.services.Update(updated)
+			return err
+		})
+	})
+}
+
+// applyEndpoints creates the Endpoints of the Service with the name or updates its subsets.
+func (r *Registry) applyEndpoints(ctx context.Context, name string, labels map[string]string, subsets []apiv1.EndpointSubset) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var current *apiv1.Endpoints
+		err := apicall.Do(ctx, func() (err error) {
+			current, err = r.client.Get(name, metav1.GetOptions{})
+			return err
+		})
+		if errors.IsNotFound(err) {
+			return apicall.Do(ctx, func() error {
+				_, err := r.client.Create(&apiv1.Endpoints{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+					Subsets:    subsets,
+				})
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		if current.Labels[r.labelKey] != serviceLabelValue {
+			return fmt.Errorf("Endpoints %s is not created by registry", name)
+		}
+		if reflect.DeepEqual(current.Subsets, subsets) {
+			return nil
+		}
+
+		updated := current.DeepCopy()
+		updated.Subsets = subsets
+		return apicall.Do(ctx, func() error {
+			_, err := r.client.Update(updated)
+			return err
+		})
+	})
+}
+
+// deleteService deletes the Service with the name and its Endpoints if they are created by
+// registry.
+func (r *Registry) deleteService(ctx context.Context, name string) error {
+	var current *apiv1.Service
+	err := apicall.Do(ctx, func() (err error) {
+		current, err = r.services.Get(name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil {
+		if current.Labels[r.labelKey] != serviceLabelValue {
+			return nil
+		}
+
+		err := apicall.Do(ctx, func() error {
+			return r.services.Delete(name, &metav1.DeleteOptions{})
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return r.deleteEndpoints(ctx, name)
+}
+
+// deleteEndpoints deletes the Endpoints of the Service with the name if it's created by registry.
+func (r *Registry) deleteEndpoints(ctx context.Context, name string) error {
+	var current *apiv1.Endpoints
+	err := apicall.Do(ctx, func() (err error) {
+		current, err = r.client.Get(name, metav1.GetOptions{})
+		return err
+	})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.Labels[r.labelKey] != serviceLabelValue {
+		return nil
+	}
+
+	err = apicall.Do(ctx, func() error {
+		return r.client.Delete(name, &metav1.DeleteOptions{})
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
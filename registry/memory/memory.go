@@ -1,42 +1,152 @@
-// Memory based registry is just used for test.
+// Memory based registry keeps the services in memory, it could persist them in a local directory
+// to run as a single node registry, but is mostly used for test.
 package memory
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
 	"time"
-    "sync"
 
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/registry/internal/expiry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
 type Registry struct {
-	mtx		sync.RWMutex
+	mtx sync.RWMutex
 	// key is the hash of service.
-	store	map[[md5.Size]byte][]byte
+	store map[[md5.Size]byte][]byte
+	// index the keys of services by name.
+	names map[string]map[[md5.Size]byte]struct{}
+
+	broadcaster *registry.Broadcaster
+
+	ttl     time.Duration
+	cleanup time.Duration
+	clock   clock.Clock
+
+	// expiry notifies the watchers once the services expire, nil if they never expire.
+	expiry *expiry.Tracker
+
+	// storage persists the services if the registry is created with WithDir.
+	storage *storage
+	// persisted is the update time of each service in storage, the heartbeats which only refresh
+	// it are not persisted every time.
+	persisted map[[md5.Size]byte]time.Time
+
+	// stop is closed by Close to stop the cleanup.
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
 type Item struct {
-	Service *types.Service 	`json:"service"`
-	Update	time.Time 		`json:"update"`
+	Service *types.Service `json:"service"`
+	Update  time.Time      `json:"update"`
 }
 
-func NewRegistry() (*Registry, error) {
-	return &Registry{
-		store:	make(map[[md5.Size]byte][]byte),
-	}, nil
+func NewRegistry(opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	if o.ttl > 0 && o.cleanup <= 0 {
+		return nil, fmt.Errorf("cleanup period should be positive when ttl is set, got %v", o.cleanup)
+	}
+
+	r := &Registry{
+		store:       make(map[[md5.Size]byte][]byte),
+		names:       make(map[string]map[[md5.Size]byte]struct{}),
+		broadcaster: registry.NewBroadcaster(),
+		ttl:         o.ttl,
+		cleanup:     o.cleanup,
+		clock:       o.clock,
+		persisted:   make(map[[md5.Size]byte]time.Time),
+		stop:        make(chan struct{}),
+	}
+
+	if r.ttl > 0 {
+		r.expiry = expiry.NewTracker(r.clock, func(service *types.Service) {
+			r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+		}, func(service *types.Service) {
+			r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+		})
+	}
+
+	if o.dir != "" {
+		if err := r.load(o.dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.ttl > 0 {
+		// Create the ticker before returning, so the fake clock stepped by tests always fires it.
+		ticker := r.clock.NewTicker(r.cleanup)
+		r.wg.Add(2)
+		go func() {
+			defer r.wg.Done()
+			r.runCleanup(ticker)
+		}()
+		go func() {
+			defer r.wg.Done()
+			r.expiry.Run(r.stop)
+		}()
+	}
+
+	return r, nil
 }
 
-func (r *Registry) Register(service *types.Service) error {
-	b, err := json.Marshal(service)
+// load replays the services persisted in dir, the expired ones are dropped, then compacts them
+// into a new snapshot.
+func (r *Registry) load(dir string) error {
+	storage, items, err := openStorage(dir)
+	if err != nil {
+		return err
+	}
+
+	now := r.clock.Now()
+	for key, item := range items {
+		if r.expired(item, now) {
+			continue
+		}
+
+		value, err := json.Marshal(item)
+		if err != nil {
+			storage.close()
+			return err
+		}
+		r.put(key, item.Service, value)
+		r.persisted[key] = item.Update
+		r.track(key, item)
+	}
+
+	r.storage = storage
+	if err := storage.compact(r.values()); err != nil {
+		storage.close()
+		return err
+	}
+
+	return nil
+}
+
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, err := keyOf(service)
 	if err != nil {
 		return err
 	}
 
 	// For simplicity, don't consider the disorder of network packets.
 	i := &Item{
-		Service:	service,
-		Update:		time.Now(),
+		Service: service,
+		Update:  r.clock.Now(),
 	}
 	value, err := json.Marshal(i)
 	if err != nil {
@@ -44,26 +154,246 @@ func (r *Registry) Register(service *types.Service) error {
 	}
 
 	r.mtx.Lock()
-	r.store[md5.Sum(b)] = value
-	r.mtx.Unlock()
+	defer r.mtx.Unlock()
+
+	if r.storage != nil && r.stale(key, i.Update) {
+		if err := r.storage.append(opRegister, i); err != nil {
+			return err
+		}
+		r.persisted[key] = i.Update
+		r.compact(false)
+	}
+
+	_, exist := r.store[key]
+	r.put(key, service, value)
+	// The key is the hash of service, so the content of an existing service never changes,
+	// only notify the newly added services. The expired service is notified as added again
+	// by the tracker once its deadline is extended.
+	if !exist {
+		r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+	}
+	r.track(key, i)
+
+	return nil
+}
+
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, err := keyOf(service)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, exist := r.store[key]; exist {
+		if r.storage != nil {
+			if err := r.storage.append(opDeregister, &Item{Service: service}); err != nil {
+				return err
+			}
+			r.compact(false)
+		}
+		r.remove(key, service)
+	}
 
 	return nil
 }
 
-func (r *Registry) ListServices() ([]*types.Service, error) {
+// put stores the service with the key, the caller must hold the lock.
+func (r *Registry) put(key [md5.Size]byte, service *types.Service, value []byte) {
+	r.store[key] = value
+	if r.names[service.Name] == nil {
+		r.names[service.Name] = make(map[[md5.Size]byte]struct{})
+	}
+	r.names[service.Name][key] = struct{}{}
+}
+
+// stale checks whether the registration of the service with the key at now should be appended
+// to the log, the caller must hold the lock. The heartbeats only refresh the update time, so
+// they're appended at most once every half ttl instead of syncing the log on each of them. The
+// snapshot written by Close has the latest update times, but after a crash the service may be
+// replayed as expired up to half ttl early, until its next heartbeat registers it again.
+func (r *Registry) stale(key [md5.Size]byte, now time.Time) bool {
+	persisted, ok := r.persisted[key]
+	if !ok {
+		return true
+	}
+	return r.ttl > 0 && now.Sub(persisted) >= r.ttl/2
+}
+
+// track tracks the deadline of the service in item, the caller must hold the lock.
+func (r *Registry) track(key [md5.Size]byte, item *Item) {
+	if r.expiry != nil {
+		r.expiry.Track(string(key[:]), item.Service, item.Update.Add(r.ttl))
+	}
+}
+
+// remove removes the service with the key, the caller must hold the lock. The expired service
+// has been notified as removed by the tracker already.
+func (r *Registry) remove(key [md5.Size]byte, service *types.Service) {
+	delete(r.store, key)
+	delete(r.persisted, key)
+	delete(r.names[service.Name], key)
+	if len(r.names[service.Name]) == 0 {
+		delete(r.names, service.Name)
+	}
+	if r.expiry != nil && r.expiry.Forget(string(key[:])) {
+		return
+	}
+	r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+}
+
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
 	r.mtx.RLock()
 	defer r.mtx.RUnlock()
 
-	res := make([]*types.Service, 0, len(r.store))
-	for _, value := range r.store {
-		item := &Item{}
-		err := json.Unmarshal(value, item)
+	var values [][]byte
+	if options.Name != "" {
+		for key := range r.names[options.Name] {
+			values = append(values, r.store[key])
+		}
+	} else {
+		for _, value := range r.store {
+			values = append(values, value)
+		}
+	}
+
+	now := r.clock.Now()
+
+	res := make([]*types.Service, 0, len(values))
+	for _, value := range values {
+		item, err := decode(value)
 		if err != nil {
 			return nil, err
 		}
 
+		if r.expired(item, now) {
+			// The registered service has expired, skip.
+			continue
+		}
+
+		if !options.Matches(item.Service) {
+			continue
+		}
+
 		res = append(res, item.Service)
 	}
 
 	return res, nil
 }
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// Close stops the cleanup and closes the channels of the watchers, the persisted services are
+// compacted into a snapshot.
+func (r *Registry) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+		r.broadcaster.Close()
+
+		if r.storage != nil {
+			r.mtx.Lock()
+			defer r.mtx.Unlock()
+			if err = r.storage.compact(r.values()); err == nil {
+				err = r.storage.close()
+			}
+		}
+	})
+	return err
+}
+
+// runCleanup cleans up the expired services every cleanup period until the registry is closed,
+// the same as the Cleanup of kubernetes registry.
+func (r *Registry) runCleanup(ticker clock.Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-r.stop:
+			return
+		}
+
+		r.deleteExpired()
+	}
+}
+
+// deleteExpired deletes the expired services, the watchers are notified when they expire.
+func (r *Registry) deleteExpired() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := r.clock.Now()
+
+	for key, value := range r.store {
+		item, err := decode(value)
+		if err != nil {
+			log.Printf("failed to unmarshal registered service: %v\n", err)
+			continue
+		}
+
+		if r.expired(item, now) {
+			r.remove(key, item.Service)
+		}
+	}
+
+	if r.storage != nil {
+		r.compact(true)
+	}
+}
+
+// compact compacts the log of storage if it's too long or force is true, the caller must hold
+// the lock. The records are still in the log if it fails, so just try again later.
+func (r *Registry) compact(force bool) {
+	if !force && r.storage.records <= compactThreshold+2*len(r.store) {
+		return
+	}
+
+	if err := r.storage.compact(r.values()); err != nil {
+		log.Printf("failed to compact the storage of registry: %v\n", err)
+	}
+}
+
+// values returns the marshaled items in store, the caller must hold the lock.
+func (r *Registry) values() [][]byte {
+	values := make([][]byte, 0, len(r.store))
+	for _, value := range r.store {
+		values = append(values, value)
+	}
+	return values
+}
+
+// expired checks whether the service in item has expired at now.
+func (r *Registry) expired(item *Item, now time.Time) bool {
+	return r.ttl > 0 && item.Update.Add(r.ttl).Before(now)
+}
+
+// keyOf returns the key of service in store.
+func keyOf(service *types.Service) ([md5.Size]byte, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return [md5.Size]byte{}, err
+	}
+	return md5.Sum(b), nil
+}
+
+func decode(value []byte) (*Item, error) {
+	item := &Item{}
+	if err := json.Unmarshal(value, item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
@@ -1,9 +1,18 @@
 package memory
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"reflect"
+	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
@@ -19,12 +28,12 @@ func TestRegistery(t *testing.T) {
 		Endpoint:	"/webhook",
 	}
 
-	err = registry.Register(service)
+	err = registry.Register(context.Background(), service)
 	if err != nil {
 		t.Fatalf("register service failed: %v", err)
 	}
 
-	services, err := registry.ListServices()
+	services, err := registry.ListServices(context.Background())
 	if err != nil {
 		t.Fatalf("list services failed: %v", err)
 	}
@@ -37,3 +46,732 @@ func TestRegistery(t *testing.T) {
 		t.Fatalf("the content of service changed after register")
 	}
 }
+
+func TestDeregister(t *testing.T) {
+	registry, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:	"localhost",
+		Port:		8080,
+		Endpoint:	"/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Deregister same service multiple times to test idempotency.
+	for i := 0; i < 2; i++ {
+		if err := registry.Deregister(context.Background(), service); err != nil {
+			t.Fatalf("deregister service failed: %v", err)
+		}
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should get 0 after deregisteration", len(services))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := r.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:	"localhost",
+		Port:		8080,
+		Endpoint:	"/webhook",
+	}
+
+	// Heartbeats of the same service should only be notified once.
+	for i := 0; i < 2; i++ {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	if err := r.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	for _, expected := range []registry.EventType{registry.Added, registry.Removed} {
+		event := <-events
+		if event.Type != expected {
+			t.Fatalf("the type of event is %v, should be %v", event.Type, expected)
+		}
+		if !reflect.DeepEqual(service, event.Service) {
+			t.Fatalf("the service of event is %v, should be %v", event.Service, service)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after cancel")
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	events, err := r.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	// Register more services than the buffer of watcher without receiving the events.
+	total := 1000
+	for i := 0; i < total; i++ {
+		service := &types.Service{
+			Address:	"localhost",
+			Port:		8080 + i,
+			Endpoint:	"/webhook",
+		}
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// The events buffered are delivered, then the channel is closed rather than dropping the rest.
+	received := 0
+	for range events {
+		received++
+	}
+	if received == 0 || received >= total {
+		t.Fatalf("the number of received events is %d, should be less than %d before closed", received, total)
+	}
+
+	// The watcher resyncs by watching and listing again.
+	if _, err := r.Watch(context.Background()); err != nil {
+		t.Fatalf("watch registry again failed: %v", err)
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != total {
+		t.Fatalf("the number of listed services is %d, should be %d", len(services), total)
+	}
+}
+
+func TestListServicesByName(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	services := []*types.Service{
+		{Name: "billing-webhook", ID: "0", Address: "localhost", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing-webhook", ID: "1", Address: "localhost", Port: 8081, Endpoint: "/webhook"},
+		{Name: "message", ID: "0", Address: "localhost", Port: 8082, Endpoint: "/message"},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	listed, err := r.ListServices(context.Background(), registry.WithName("billing-webhook"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("the number of listed services is %d, should get 2", len(listed))
+	}
+
+	if err := r.Deregister(context.Background(), services[2]); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	listed, err = r.ListServices(context.Background(), registry.WithName("message"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 0 {
+		t.Fatalf("the number of listed services is %d, should get 0 after deregisteration", len(listed))
+	}
+}
+
+func TestListServicesBySelector(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	services := []*types.Service{
+		{Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"version": "v1"}},
+		{Address: "localhost", Port: 8081, Endpoint: "/webhook", Metadata: map[string]string{"version": "v2"}},
+		{Address: "localhost", Port: 8082, Endpoint: "/webhook"},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	selector, err := labels.Parse("version=v2")
+	if err != nil {
+		t.Fatalf("parse selector failed: %v", err)
+	}
+
+	listed, err := r.ListServices(context.Background(), registry.WithSelector(selector))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(listed) != 1 || !reflect.DeepEqual(services[1], listed[0]) {
+		t.Fatalf("the listed services are %v, should get %v", listed, services[1])
+	}
+}
+
+func TestListServicesByFields(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	services := []*types.Service{
+		{ID: "0", Address: "10.0.0.1", Port: 8080, Endpoint: "/webhook"},
+		{ID: "1", Address: "10.0.0.2", Port: 8081, Endpoint: "/message"},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	for _, opt := range []registry.ListOption{
+		registry.WithID("1"),
+		registry.WithAddress("10.0.0.2"),
+		registry.WithPort(8081),
+		registry.WithEndpoint("/message"),
+	} {
+		listed, err := r.ListServices(context.Background(), opt)
+		if err != nil {
+			t.Fatalf("list services failed: %v", err)
+		}
+
+		if len(listed) != 1 || !reflect.DeepEqual(services[1], listed[0]) {
+			t.Fatalf("the listed services are %v, should get %v", listed, services[1])
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	events, err := r.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after the registry is closed")
+	}
+
+	if _, err := r.Watch(context.Background()); err == nil {
+		t.Fatalf("watch a closed registry should fail")
+	}
+
+	// Close is idempotent.
+	if err := r.Close(); err != nil {
+		t.Fatalf("close registry again failed: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := r.Register(ctx, service); err != context.Canceled {
+		t.Fatalf("register service with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0", len(services))
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithTTL(time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	fakeClock.Step(2 * time.Minute)
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after the service expired", len(services))
+	}
+
+	// Register again, the service comes back.
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err = r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should be 1 after registering again", len(services))
+	}
+}
+
+func TestServiceCleanup(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithTTL(time.Minute), WithCleanup(10*time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	events, err := r.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	expired := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), expired); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	fakeClock.Step(9*time.Minute + 30*time.Second)
+
+	// Keep registering, so the service is alive when cleaning up.
+	alive := &types.Service{
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), alive); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// The expired service is notified as removed when it expires, not when it's cleaned up.
+	expected := []registry.Event{
+		{Type: registry.Added, Service: expired},
+		{Type: registry.Removed, Service: expired},
+		{Type: registry.Added, Service: alive},
+	}
+	// The expiry is notified asynchronously, so it may come after registering the alive one.
+	received := make(map[registry.EventType]int)
+	for range expected {
+		select {
+		case event := <-events:
+			received[event.Type]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the events are not received in time")
+		}
+	}
+	if received[registry.Added] != 2 || received[registry.Removed] != 1 {
+		t.Fatalf("the received events are %v, should be %v", received, expected)
+	}
+
+	// Trigger the cleanup.
+	fakeClock.Step(30 * time.Second)
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v %v, the expired service has been notified", event.Type, event.Service)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.mtx.RLock()
+	size := len(r.store)
+	r.mtx.RUnlock()
+	if size != 1 {
+		t.Fatalf("the number of stored services is %d, should be 1 after cleanup", size)
+	}
+}
+
+func TestExpireEvents(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithTTL(time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	events, err := r.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	expectEvent := func(eventType registry.EventType) {
+		select {
+		case event := <-events:
+			if event.Type != eventType || !reflect.DeepEqual(service, event.Service) {
+				t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, eventType, service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the event %v is not received in time", eventType)
+		}
+	}
+
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(registry.Added)
+
+	fakeClock.Step(2 * time.Minute)
+	expectEvent(registry.Removed)
+
+	// Register again before the cleanup, the service comes back.
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+	expectEvent(registry.Added)
+
+	if err := r.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+	expectEvent(registry.Removed)
+}
+
+func TestInvalidCleanup(t *testing.T) {
+	if _, err := NewRegistry(WithTTL(time.Minute), WithCleanup(0)); err == nil {
+		t.Fatalf("create registry with ttl but no cleanup period should fail")
+	}
+
+	// The services never expire by default, so the cleanup period doesn't matter.
+	r, err := NewRegistry(WithCleanup(0))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	r.Close()
+}
+
+func TestNeverExpire(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	fakeClock.Step(24 * time.Hour)
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should be 1 by default", len(services))
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-registry")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRegistry(WithDir(dir))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	kept := &types.Service{
+		Name:     "kept",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+	removed := &types.Service{
+		Name:     "removed",
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+	}
+
+	for _, service := range []*types.Service{kept, removed} {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+	if err := r.Deregister(context.Background(), removed); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	// Restart without closing, as if the registry crashed.
+	restarted, err := NewRegistry(WithDir(dir))
+	if err != nil {
+		t.Fatalf("restart registry failed: %v", err)
+	}
+
+	services, err := restarted.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(kept, services[0]) {
+		t.Fatalf("the listed services are %v after restart, should be [%v]", services, kept)
+	}
+
+	if err := restarted.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	// All the records are compacted into the snapshot after close.
+	info, err := os.Stat(filepath.Join(dir, logFile))
+	if err != nil {
+		t.Fatalf("stat log failed: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("the size of log is %d after close, should be 0", info.Size())
+	}
+
+	restarted, err = NewRegistry(WithDir(dir))
+	if err != nil {
+		t.Fatalf("restart registry failed: %v", err)
+	}
+	defer restarted.Close()
+
+	services, err = restarted.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(kept, services[0]) {
+		t.Fatalf("the listed services are %v after restart, should be [%v]", services, kept)
+	}
+}
+
+func TestPersistenceExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-registry")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithDir(dir), WithTTL(time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	expired := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), expired); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	fakeClock.Step(45 * time.Second)
+
+	alive := &types.Service{
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), alive); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	// The registry is down for a while, the ttl is re-evaluated on restart.
+	fakeClock.Step(30 * time.Second)
+
+	restarted, err := NewRegistry(WithDir(dir), WithTTL(time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("restart registry failed: %v", err)
+	}
+	defer restarted.Close()
+
+	services, err := restarted.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(alive, services[0]) {
+		t.Fatalf("the listed services are %v after restart, should be [%v]", services, alive)
+	}
+}
+
+func TestPersistenceHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-registry")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	r, err := NewRegistry(WithDir(dir), WithTTL(time.Minute), WithClock(fakeClock))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer r.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// The heartbeats which only refresh the update time are not logged.
+	for i := 0; i < 10; i++ {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+		fakeClock.Step(time.Second)
+	}
+
+	r.mtx.RLock()
+	records := r.storage.records
+	r.mtx.RUnlock()
+	if records != 1 {
+		t.Fatalf("the number of records in log is %d, should be 1", records)
+	}
+
+	// The update time is logged again once it's half ttl old.
+	fakeClock.Step(30 * time.Second)
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	r.mtx.RLock()
+	records = r.storage.records
+	r.mtx.RUnlock()
+	if records != 2 {
+		t.Fatalf("the number of records in log is %d, should be 2", records)
+	}
+}
+
+func TestPersistenceTornLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-registry")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRegistry(WithDir(dir))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	// Crash in the middle of appending a record.
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("open log failed: %v", err)
+	}
+	if _, err := f.WriteString(`{"op":"register","item":{"serv`); err != nil {
+		t.Fatalf("write log failed: %v", err)
+	}
+	f.Close()
+
+	restarted, err := NewRegistry(WithDir(dir))
+	if err != nil {
+		t.Fatalf("restart registry failed: %v", err)
+	}
+	defer restarted.Close()
+
+	services, err := restarted.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the listed services are %v after restart, should be [%v]", services, service)
+	}
+}
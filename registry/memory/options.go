@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+type options struct {
+	// The registered service expires if it's not registered again in ttl, never expire if it's 0.
+	ttl time.Duration
+	// The expired services are cleaned up every cleanup period.
+	cleanup time.Duration
+
+	clock clock.Clock
+
+	// Directory to persist the services, only kept in memory if it's empty.
+	dir string
+}
+
+type Option func(*options)
+
+// WithTTL expires the services which are not registered again in ttl, the services never
+// expire by default.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithCleanup sets the period to delete the expired services from memory, it must be positive
+// if ttl is set. The expired services are invisible right away, so it only bounds the memory.
+func WithCleanup(cleanup time.Duration) Option {
+	return func(o *options) {
+		o.cleanup = cleanup
+	}
+}
+
+// WithClock replaces the clock to tell the expired services, the tests step clock.NewFakeClock()
+// past the ttl and the cleanup period instead of sleeping.
+func WithClock(clock clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithDir persists the services in dir, so they survive the restart of registry. The services
+// are replayed from dir on start and the expired ones are dropped.
+func WithDir(dir string) Option {
+	return func(o *options) {
+		o.dir = dir
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		cleanup: 10 * time.Minute,
+		clock:   clock.RealClock{},
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
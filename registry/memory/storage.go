@@ -0,0 +1,196 @@
+package memory
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "log.jsonl"
+
+	opRegister   = "register"
+	opDeregister = "deregister"
+
+	// The log is compacted into the snapshot when it has more records than this plus twice
+	// the number of services, so the heartbeats don't grow it forever.
+	compactThreshold = 1024
+)
+
+// storage persists the registered services in a directory, a snapshot of the services and an
+// append-only log of the registrations since the snapshot, most heartbeats are not logged. Replaying the log on the snapshot
+// is idempotent, so it's safe to crash at any time, even in the middle of compaction.
+type storage struct {
+	dir string
+	log *os.File
+	// records is the number of records in the log.
+	records int
+}
+
+type record struct {
+	Op   string `json:"op"`
+	Item *Item  `json:"item"`
+}
+
+// openStorage opens the storage in dir and returns the services replayed from it.
+func openStorage(dir string) (*storage, map[[md5.Size]byte]*Item, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	items := make(map[[md5.Size]byte]*Item)
+
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		var list []*Item
+		if err := json.Unmarshal(snapshot, &list); err != nil {
+			return nil, nil, fmt.Errorf("load snapshot failed: %v", err)
+		}
+		for _, item := range list {
+			key, err := keyOf(item.Service)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = item
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &storage{dir: dir, log: f}
+	if err := s.replay(items); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return s, items, nil
+}
+
+// replay applies the records in the log to items. A torn record at the end of log is left by
+// the crash in the middle of appending, the replay stops there.
+func (s *storage) replay(items map[[md5.Size]byte]*Item) error {
+	scanner := bufio.NewScanner(s.log)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		r := &record{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil || r.Item == nil || r.Item.Service == nil {
+			log.Printf("stop replaying the log of %v at a broken record: %v\n", s.dir, err)
+			break
+		}
+
+		key, err := keyOf(r.Item.Service)
+		if err != nil {
+			return err
+		}
+
+		switch r.Op {
+		case opRegister:
+			items[key] = r.Item
+		case opDeregister:
+			delete(items, key)
+		}
+		s.records++
+	}
+
+	return scanner.Err()
+}
+
+// append appends a record to the log and syncs it to disk.
+func (s *storage) append(op string, item *Item) error {
+	b, err := json.Marshal(&record{Op: op, Item: item})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.log.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.records++
+	return nil
+}
+
+// compact writes the services to a new snapshot and truncates the log. The values are the
+// marshaled items in the store.
+func (s *storage) compact(values [][]byte) error {
+	list := make([]json.RawMessage, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	if err := writeFile(tmp, b); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	// The snapshot has all the records, it doesn't matter if we crash before truncating.
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	s.records = 0
+	return nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+// writeFile writes b to the file with the name and syncs it to disk.
+func writeFile(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir syncs the directory, so the renamed file survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
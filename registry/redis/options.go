@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+type options struct {
+	// Address of redis, default is "127.0.0.1:6379".
+	address  string
+	password string
+	db       int
+	tls      *tls.Config
+
+	// Prefix of the keys and the channel of registry, default is "kr:". It's the hash tag of the
+	// keys, such as "{kr:}services", so they're in the same slot of Redis Cluster.
+	prefix string
+
+	// The key of each registered service expires in ttl, and it's not listed if it's not registered
+	// again in ttl.
+	ttl time.Duration
+	// The expired services are removed from the sorted set every cleanup period.
+	cleanup time.Duration
+}
+
+type Option func(*options)
+
+func WithAddress(address string) Option {
+	return func(o *options) {
+		o.address = address
+	}
+}
+
+func WithPassword(password string) Option {
+	return func(o *options) {
+		o.password = password
+	}
+}
+
+func WithDB(db int) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithTLS connects to redis over TLS with the config.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithPrefix changes the prefix of keys, so multiple registries could be isolated in the same
+// redis. The prefix is wrapped in braces as the hash tag of keys, it must not be empty or contain
+// braces itself.
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+func WithCleanup(cleanup time.Duration) Option {
+	return func(o *options) {
+		o.cleanup = cleanup
+	}
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		address: "127.0.0.1:6379",
+		prefix:  "kr:",
+		ttl:     60 * time.Second,
+		cleanup: 10 * time.Minute,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
@@ -0,0 +1,373 @@
+// Redis based registry stores each service in a key expiring in ttl, and the last seen time of
+// services in a sorted set for listing. The changes are published to a channel, so all the
+// replicas sharing the redis could notify their watchers. All the keys are under the hash tag of
+// the prefix, so the scripts touching several of them work on Redis Cluster too.
+package redis
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// registerScript stores the service and marks it seen now, the added event is published if the
+// service is new or has expired. KEYS: sorted set, key of service. ARGV: service, item, now, ttl
+// in milliseconds, channel, the added event.
+var registerScript = goredis.NewScript(`
+local seen = redis.call('ZSCORE', KEYS[1], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[4])
+if (not seen) or tonumber(seen) + tonumber(ARGV[4]) < tonumber(ARGV[3]) then
+	redis.call('PUBLISH', ARGV[5], ARGV[6])
+	return 1
+end
+return 0
+`)
+
+// deregisterScript removes the service, the removed event is published if it's removed by us.
+// KEYS: sorted set, key of service. ARGV: service, channel, the removed event.
+var deregisterScript = goredis.NewScript(`
+redis.call('DEL', KEYS[2])
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+	redis.call('PUBLISH', ARGV[2], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// expireScript removes the service if it's not seen since the deadline, so the service
+// registered again by another replica in the meantime is kept. KEYS: sorted set. ARGV: service,
+// deadline, channel, the removed event.
+var expireScript = goredis.NewScript(`
+local seen = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if seen and tonumber(seen) < tonumber(ARGV[2]) then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('PUBLISH', ARGV[3], ARGV[4])
+	return 1
+end
+return 0
+`)
+
+type Registry struct {
+	client goredis.UniversalClient
+	// closeClient is true if the client is created by registry, so it's closed with registry.
+	closeClient bool
+
+	// prefix is the hash tag of the keys, such as "{kr:}".
+	prefix  string
+	ttl     time.Duration
+	cleanup time.Duration
+
+	broadcaster *registry.Broadcaster
+	pubsub      *goredis.PubSub
+
+	// stop is closed by Close to stop the cleanup and the dispatching of events.
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type Item struct {
+	Service *types.Service `json:"service"`
+	Update  time.Time      `json:"update"`
+}
+
+// message is the event published to the channel of registry.
+type message struct {
+	Type    registry.EventType `json:"type"`
+	Service *types.Service     `json:"service"`
+}
+
+func NewRegistry(opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	client := goredis.NewClient(&goredis.Options{
+		Addr:      o.address,
+		Password:  o.password,
+		DB:        o.db,
+		TLSConfig: o.tls,
+	})
+
+	r, err := newRegistry(client, opts...)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	r.closeClient = true
+
+	return r, nil
+}
+
+// Easy for test: take the client of miniredis as input. The client could be a cluster client as
+// well, the keys of registry are in the same slot.
+func newRegistry(client goredis.UniversalClient, opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	// An empty hash tag doesn't count, the whole keys would be hashed to different slots.
+	if o.prefix == "" || strings.ContainsAny(o.prefix, "{}") {
+		return nil, fmt.Errorf("invalid prefix %q: should be non-empty without braces", o.prefix)
+	}
+
+	r := &Registry{
+		client:      client,
+		prefix:      "{" + o.prefix + "}",
+		ttl:         o.ttl,
+		cleanup:     o.cleanup,
+		broadcaster: registry.NewBroadcaster(),
+		stop:        make(chan struct{}),
+	}
+
+	// Subscribe before serving, so no change would be missed after the registry is created.
+	r.pubsub = client.Subscribe(context.Background(), r.channel())
+	if _, err := r.pubsub.Receive(context.Background()); err != nil {
+		r.pubsub.Close()
+		return nil, wrap(err)
+	}
+
+	events := r.pubsub.Channel()
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.dispatch(events)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.Cleanup()
+	}()
+
+	return r, nil
+}
+
+// Close stops the cleanup and the subscription, and closes the channels of the watchers, the
+// client is closed if it's created by registry.
+func (r *Registry) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		err = r.pubsub.Close()
+		r.wg.Wait()
+		r.broadcaster.Close()
+
+		if r.closeClient {
+			if cerr := r.client.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// services is the key of the sorted set of services, the members are the services and their
+// scores are the last seen time in milliseconds.
+func (r *Registry) services() string {
+	return r.prefix + "services"
+}
+
+func (r *Registry) channel() string {
+	return r.prefix + "events"
+}
+
+// key returns the key of service, it's the hash of service under its name.
+func (r *Registry) key(member string, service *types.Service) string {
+	sum := md5.Sum([]byte(member))
+	return r.prefix + "service:" + service.Name + ":" + hex.EncodeToString(sum[:])
+}
+
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	member, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	item, err := json.Marshal(&Item{
+		Service: service,
+		Update:  now,
+	})
+	if err != nil {
+		return err
+	}
+
+	event, err := json.Marshal(&message{Type: registry.Added, Service: service})
+	if err != nil {
+		return err
+	}
+
+	keys := []string{r.services(), r.key(string(member), service)}
+	err = registerScript.Run(ctx, r.client, keys,
+		member, item, now.UnixNano()/int64(time.Millisecond), r.ttl.Milliseconds(), r.channel(), event).Err()
+	return wrap(err)
+}
+
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	member, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	event, err := json.Marshal(&message{Type: registry.Removed, Service: service})
+	if err != nil {
+		return err
+	}
+
+	keys := []string{r.services(), r.key(string(member), service)}
+	return wrap(deregisterScript.Run(ctx, r.client, keys, member, r.channel(), event).Err())
+}
+
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	// The services not seen in ttl have expired, skip.
+	deadline := time.Now().Add(-r.ttl).UnixNano() / int64(time.Millisecond)
+	members, err := r.client.ZRangeByScore(ctx, r.services(), &goredis.ZRangeBy{
+		Min: strconv.FormatInt(deadline, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	res := make([]*types.Service, 0, len(members))
+	for _, member := range members {
+		service := &types.Service{}
+		if err := json.Unmarshal([]byte(member), service); err != nil {
+			log.Printf("failed to unmarshal registered service %q: %v\n", member, err)
+			continue
+		}
+
+		if !options.Matches(service) {
+			continue
+		}
+
+		res = append(res, service)
+	}
+
+	return res, nil
+}
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// dispatch notifies the watchers of the events published by all the replicas until the
+// subscription is closed. The subscription is re-established by the client if the connection is
+// broken, the events published in the meantime are lost.
+func (r *Registry) dispatch(events <-chan *goredis.Message) {
+	for msg := range events {
+		m := &message{}
+		if err := json.Unmarshal([]byte(msg.Payload), m); err != nil || m.Service == nil {
+			log.Printf("failed to unmarshal event %q: %v\n", msg.Payload, err)
+			continue
+		}
+
+		r.broadcaster.Notify(registry.Event{Type: m.Type, Service: m.Service})
+	}
+}
+
+// Cleanup removes the expired services from the sorted set every cleanup period, their keys are
+// already expired by redis. It's safe to run it in all the replicas, each expired service is
+// removed and notified only once. It returns after the registry is closed.
+func (r *Registry) Cleanup() {
+	ticker := time.NewTicker(r.cleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		if err := r.deleteExpired(context.Background()); err != nil {
+			log.Printf("failed to clean up expired services: %v\n", err)
+		}
+	}
+}
+
+// deleteExpired removes the services not seen in ttl.
+func (r *Registry) deleteExpired(ctx context.Context) error {
+	deadline := strconv.FormatInt(time.Now().Add(-r.ttl).UnixNano()/int64(time.Millisecond), 10)
+	members, err := r.client.ZRangeByScore(ctx, r.services(), &goredis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + deadline,
+	}).Result()
+	if err != nil {
+		return wrap(err)
+	}
+
+	for _, member := range members {
+		service := &types.Service{}
+		if err := json.Unmarshal([]byte(member), service); err != nil {
+			log.Printf("failed to unmarshal registered service %q: %v\n", member, err)
+			continue
+		}
+
+		event, err := json.Marshal(&message{Type: registry.Removed, Service: service})
+		if err != nil {
+			return err
+		}
+
+		keys := []string{r.services()}
+		if err := expireScript.Run(ctx, r.client, keys, member, deadline, r.channel(), event).Err(); err != nil {
+			return wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// wrap wraps the error of redis with the matching error of registry, the other errors are
+// returned as is.
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", registry.ErrTimeout, err)
+	}
+	if netErr != nil || errors.Is(err, io.EOF) || errors.Is(err, goredis.ErrClosed) {
+		return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+	}
+
+	// The errors replied by redis start with their kinds.
+	var redisErr goredis.Error
+	if errors.As(err, &redisErr) {
+		kind := strings.SplitN(redisErr.Error(), " ", 2)[0]
+		switch kind {
+		case "NOAUTH", "NOPERM", "WRONGPASS":
+			return fmt.Errorf("%w: %v", registry.ErrForbidden, err)
+		case "LOADING", "BUSY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN", "READONLY":
+			return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+		}
+	}
+
+	return err
+}
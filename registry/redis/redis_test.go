@@ -0,0 +1,446 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+
+	regapi "github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// startRedis starts a redis stand-in in process and returns a client of it.
+func startRedis(t *testing.T) (*miniredis.Miniredis, goredis.UniversalClient) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis failed: %v", err)
+	}
+
+	return s, goredis.NewClient(&goredis.Options{Addr: s.Addr()})
+}
+
+// expectEvent waits for the event of the service.
+func expectEvent(t *testing.T, events <-chan regapi.Event, expected regapi.EventType, service *types.Service) {
+	select {
+	case event := <-events:
+		if event.Type != expected || !reflect.DeepEqual(service, event.Service) {
+			t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, expected, service)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the event %v of %v is not received in time", expected, service)
+	}
+}
+
+func TestRegistery(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err = registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should get 1", len(services))
+	}
+
+	if !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the content of service changed after register")
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client, WithTTL(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	keys := s.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("the keys in redis are %v, should be the sorted set and the key of service", keys)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after expired", len(services))
+	}
+
+	// The key of service is expired by redis.
+	s.FastForward(200 * time.Millisecond)
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != registry.services() {
+		t.Fatalf("the keys in redis are %v, should only be the sorted set", keys)
+	}
+}
+
+func TestServiceCleanup(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client, WithTTL(100*time.Millisecond), WithCleanup(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	expectEvent(t, events, regapi.Removed, service)
+
+	if members, err := s.ZMembers(registry.services()); err == nil && len(members) != 0 {
+		t.Fatalf("the members of sorted set are %v, should be empty after cleanup", members)
+	}
+}
+
+func TestKeepRegisterService(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client, WithTTL(200*time.Millisecond), WithCleanup(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// Keep registering for longer than ttl, the service is neither expired nor notified again.
+	for i := 0; i < 6; i++ {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v %v when keeping registering", event.Type, event.Service)
+	default:
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should be 1", len(services))
+	}
+}
+
+func TestDeregisterService(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	if err := registry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	expectEvent(t, events, regapi.Removed, service)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after deregister", len(services))
+	}
+
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Fatalf("the keys in redis are %v, should be empty after deregister", keys)
+	}
+}
+
+func TestListServicesByName(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	foo := &types.Service{
+		Name:     "foo",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	bar := &types.Service{
+		Name:     "bar",
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+	}
+
+	for _, service := range []*types.Service{foo, bar} {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	services, err := registry.ListServices(context.Background(), regapi.WithName("foo"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(foo, services[0]) {
+		t.Fatalf("the listed services are %v, should be [%v]", services, foo)
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	for _, prefix := range []string{"", "{kr}:"} {
+		if _, err := newRegistry(client, WithPrefix(prefix)); err == nil {
+			t.Fatalf("create registry with prefix %q should fail", prefix)
+		}
+	}
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	for _, name := range []string{"foo", "bar"} {
+		service := &types.Service{
+			Name:     name,
+			Address:  "localhost",
+			Port:     8080,
+			Endpoint: "/webhook",
+		}
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	// All the keys are in the same slot of Redis Cluster, so the scripts don't fail with CROSSSLOT.
+	keys := s.Keys()
+	if len(keys) != 3 {
+		t.Fatalf("the keys in redis are %v, should be the sorted set and the keys of 2 services", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "{kr:}") {
+			t.Fatalf("the key %s is not under the hash tag {kr:}", key)
+		}
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	first, err := newRegistry(client, WithTTL(100*time.Millisecond), WithCleanup(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer first.Close()
+
+	second, err := newRegistry(client, WithTTL(100*time.Millisecond), WithCleanup(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer second.Close()
+
+	events, err := second.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// The service registered to one replica is notified by the other, and it's removed only once
+	// though both replicas clean up.
+	if err := first.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	expectEvent(t, events, regapi.Removed, service)
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %v %v after the service is removed", event.Type, event.Service)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after the registry is closed")
+	}
+
+	// The client passed in is not closed with registry.
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("ping with the client after the registry is closed failed: %v", err)
+	}
+
+	// Close is idempotent.
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry again failed: %v", err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	s, client := startRedis(t)
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	s.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(context.Background(), service); !errors.Is(err, regapi.ErrUnavailable) {
+		t.Fatalf("register service when redis is down returns %v, should be %v", err, regapi.ErrUnavailable)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	s, client := startRedis(t)
+	defer s.Close()
+
+	registry, err := newRegistry(client)
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	defer registry.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(ctx, service); err != context.Canceled {
+		t.Fatalf("register service with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+
+	if _, err := registry.ListServices(ctx); err != context.Canceled {
+		t.Fatalf("list services with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,86 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema in order, the applied versions are recorded in schema_migrations.
+// Never change an applied migration, append a new one instead. The statements must work on both
+// SQLite and PostgreSQL.
+var migrations = [][]string{
+	// 1: services with their heartbeat time, and their metadata.
+	{
+		`CREATE TABLE services (
+			id            VARCHAR(32) PRIMARY KEY,
+			name          VARCHAR(63) NOT NULL,
+			instance      VARCHAR(253) NOT NULL,
+			address       VARCHAR(253) NOT NULL,
+			port          INTEGER NOT NULL,
+			endpoint      TEXT NOT NULL,
+			registered_at BIGINT NOT NULL,
+			heartbeat_at  BIGINT NOT NULL
+		)`,
+		// The expired services are queried by heartbeat time.
+		`CREATE INDEX services_heartbeat_at ON services (heartbeat_at)`,
+		`CREATE INDEX services_name ON services (name, heartbeat_at)`,
+		`CREATE TABLE metadata (
+			service VARCHAR(32) NOT NULL REFERENCES services (id) ON DELETE CASCADE,
+			name    VARCHAR(317) NOT NULL,
+			value   TEXT NOT NULL,
+			PRIMARY KEY (service, name)
+		)`,
+	},
+}
+
+// migrate applies the migrations not applied yet. The replicas may migrate concurrently, the
+// migration fails in all of them but one, then it's applied already.
+func (r *Registry) migrate(ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	for i, statements := range migrations {
+		version := i + 1
+
+		applied, err := r.version(ctx)
+		if err != nil {
+			return err
+		}
+		if applied >= version {
+			continue
+		}
+
+		if err := r.apply(ctx, version, statements); err != nil {
+			if applied, verr := r.version(ctx); verr == nil && applied >= version {
+				continue
+			}
+			return fmt.Errorf("apply migration %d failed: %v", version, err)
+		}
+	}
+
+	return nil
+}
+
+// version returns the latest applied version of schema, 0 if there is none.
+func (r *Registry) version(ctx context.Context) (int, error) {
+	var version int
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// apply applies the statements of a migration and records its version in a transaction.
+func (r *Registry) apply(ctx context.Context, version int, statements []string) error {
+	return r.transact(ctx, func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.ExecContext(ctx, r.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+		return err
+	})
+}
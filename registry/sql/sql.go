@@ -0,0 +1,479 @@
+// SQL based registry stores the services in a relational database through database/sql, it works
+// with SQLite and PostgreSQL. Each service is a row with its heartbeat time, so the expired ones
+// are found by an indexed query.
+package sql
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+type Registry struct {
+	db *sql.DB
+	// closeDB is true if the db is opened by registry, so it's closed with registry.
+	closeDB bool
+	// postgres is true if the placeholders are $1, $2... instead of ?.
+	postgres bool
+
+	ttl     time.Duration
+	cleanup time.Duration
+	poll    time.Duration
+
+	mtx sync.Mutex
+	// known are the alive services notified to the watchers, key is the id of service.
+	known       map[string]*types.Service
+	broadcaster *registry.Broadcaster
+
+	// stop is closed by Close to stop the cleanup and the polling.
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewRegistry(opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	db, err := sql.Open(o.driver, o.dataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newRegistry(db, o.driver, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	r.closeDB = true
+
+	return r, nil
+}
+
+// Easy for test: take the db of a temporary SQLite file as input.
+func newRegistry(db *sql.DB, driver string, opts ...Option) (*Registry, error) {
+	o := newOptions(opts...)
+
+	// SQLite allows only one writer, serialize the writes instead of failing with busy.
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+
+	r := &Registry{
+		db:          db,
+		postgres:    driver == "postgres" || driver == "pgx",
+		ttl:         o.ttl,
+		cleanup:     o.cleanup,
+		poll:        o.poll,
+		known:       make(map[string]*types.Service),
+		broadcaster: registry.NewBroadcaster(),
+		stop:        make(chan struct{}),
+	}
+
+	ctx := context.Background()
+	if err := r.migrate(ctx); err != nil {
+		return nil, wrap(err)
+	}
+
+	known, err := r.list(ctx, "")
+	if err != nil {
+		return nil, wrap(err)
+	}
+	r.known = known
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.Cleanup()
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.runPoll()
+	}()
+
+	return r, nil
+}
+
+// Close stops the cleanup and the polling, and closes the channels of the watchers, the db is
+// closed if it's opened by registry.
+func (r *Registry) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+		r.broadcaster.Close()
+
+		if r.closeDB {
+			err = r.db.Close()
+		}
+	})
+	return err
+}
+
+func (r *Registry) Register(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	id, err := keyOf(service)
+	if err != nil {
+		return err
+	}
+
+	now := millis(time.Now())
+	err = r.transact(ctx, func(tx *sql.Tx) error {
+		// The id is the hash of service, so the registered service never changes, just renew its
+		// heartbeat.
+		res, err := tx.ExecContext(ctx, r.rebind(`UPDATE services SET heartbeat_at = ? WHERE id = ?`), now, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+
+		// Another replica may insert the same service in the meantime.
+		_, err = tx.ExecContext(ctx, r.rebind(`INSERT INTO services
+			(id, name, instance, address, port, endpoint, registered_at, heartbeat_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET heartbeat_at = excluded.heartbeat_at`),
+			id, service.Name, service.ID, service.Address, service.Port, service.Endpoint, now, now)
+		if err != nil {
+			return err
+		}
+
+		for key, value := range service.Metadata {
+			_, err := tx.ExecContext(ctx, r.rebind(`INSERT INTO metadata (service, name, value) VALUES (?, ?, ?)
+				ON CONFLICT (service, name) DO NOTHING`), id, key, value)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return wrap(err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, exist := r.known[id]; !exist {
+		r.known[id] = service
+		r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+	}
+
+	return nil
+}
+
+func (r *Registry) Deregister(ctx context.Context, service *types.Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	id, err := keyOf(service)
+	if err != nil {
+		return err
+	}
+
+	err = r.transact(ctx, func(tx *sql.Tx) error {
+		// Delete the metadata explicitly, SQLite doesn't cascade unless foreign keys are enabled.
+		if _, err := tx.ExecContext(ctx, r.rebind(`DELETE FROM metadata WHERE service = ?`), id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, r.rebind(`DELETE FROM services WHERE id = ?`), id)
+		return err
+	})
+	if err != nil {
+		return wrap(err)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, exist := r.known[id]; exist {
+		delete(r.known, id)
+		r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+	}
+
+	return nil
+}
+
+func (r *Registry) ListServices(ctx context.Context, opts ...registry.ListOption) ([]*types.Service, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options := registry.NewListOptions(opts...)
+
+	services, err := r.list(ctx, options.Name)
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	res := make([]*types.Service, 0, len(services))
+	for _, service := range services {
+		if !options.Matches(service) {
+			continue
+		}
+
+		res = append(res, service)
+	}
+
+	return res, nil
+}
+
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.Event, error) {
+	return r.broadcaster.Watch(ctx)
+}
+
+// list returns the services whose heartbeats are in ttl, with the name if it's not empty.
+func (r *Registry) list(ctx context.Context, name string) (map[string]*types.Service, error) {
+	deadline := millis(time.Now().Add(-r.ttl))
+
+	query := `SELECT id, name, instance, address, port, endpoint FROM services WHERE heartbeat_at >= ?`
+	args := []interface{}{deadline}
+	if name != "" {
+		query += ` AND name = ?`
+		args = append(args, name)
+	}
+
+	services := make(map[string]*types.Service)
+	err := r.query(ctx, query, args, func(rows *sql.Rows) error {
+		var id string
+		service := &types.Service{}
+		if err := rows.Scan(&id, &service.Name, &service.ID, &service.Address, &service.Port, &service.Endpoint); err != nil {
+			return err
+		}
+		services[id] = service
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `SELECT m.service, m.name, m.value FROM metadata m JOIN services s ON s.id = m.service
+		WHERE s.heartbeat_at >= ?`
+	if name != "" {
+		query += ` AND s.name = ?`
+	}
+
+	err = r.query(ctx, query, args, func(rows *sql.Rows) error {
+		var id, key, value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return err
+		}
+
+		// The service is registered after it's queried, skip.
+		service, exist := services[id]
+		if !exist {
+			return nil
+		}
+		if service.Metadata == nil {
+			service.Metadata = make(map[string]string)
+		}
+		service.Metadata[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// Cleanup deletes the expired services every cleanup period, the query is conditioned on the
+// heartbeat time, so it's safe to run it in all the replicas. It returns after the registry is
+// closed.
+func (r *Registry) Cleanup() {
+	ticker := time.NewTicker(r.cleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		if err := r.deleteExpired(context.Background()); err != nil {
+			log.Printf("failed to clean up expired services: %v\n", err)
+		}
+	}
+}
+
+// deleteExpired deletes the services whose heartbeats are older than ttl.
+func (r *Registry) deleteExpired(ctx context.Context) error {
+	deadline := millis(time.Now().Add(-r.ttl))
+
+	return wrap(r.transact(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, r.rebind(`DELETE FROM metadata WHERE service IN
+			(SELECT id FROM services WHERE heartbeat_at < ?)`), deadline)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, r.rebind(`DELETE FROM services WHERE heartbeat_at < ?`), deadline)
+		return err
+	}))
+}
+
+// runPoll notifies the watchers of the services registered to the other replicas and the expired
+// services every poll period until the registry is closed.
+func (r *Registry) runPoll() {
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		if err := r.sync(context.Background()); err != nil {
+			log.Printf("failed to poll services: %v\n", err)
+		}
+	}
+}
+
+// sync lists the alive services and notifies the differences from the known ones. The lock is
+// held while listing, so the changes made by this replica in the meantime are not reverted.
+func (r *Registry) sync(ctx context.Context) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	services, err := r.list(ctx, "")
+	if err != nil {
+		return wrap(err)
+	}
+
+	for id, service := range services {
+		if _, exist := r.known[id]; !exist {
+			r.broadcaster.Notify(registry.Event{Type: registry.Added, Service: service})
+		}
+	}
+	for id, service := range r.known {
+		if _, exist := services[id]; !exist {
+			r.broadcaster.Notify(registry.Event{Type: registry.Removed, Service: service})
+		}
+	}
+
+	r.known = services
+	return nil
+}
+
+// query runs the query and calls scan for each row.
+func (r *Registry) query(ctx context.Context, query string, args []interface{}, scan func(*sql.Rows) error) error {
+	rows, err := r.db.QueryContext(ctx, r.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// transact runs fn in a transaction, it's rolled back if fn fails.
+func (r *Registry) transact(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebind replaces the ? placeholders in query with $1, $2... for PostgreSQL.
+func (r *Registry) rebind(query string) string {
+	if !r.postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// keyOf returns the id of service, it's the hash of service.
+func keyOf(service *types.Service) (string, error) {
+	b, err := json.Marshal(service)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// wrap wraps the error of database with the matching error of registry, the other errors are
+// returned as is. The drivers of PostgreSQL report the SQLSTATE of errors.
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", registry.ErrTimeout, err)
+	}
+	if netErr != nil || errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+	}
+
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		state := stateErr.SQLState()
+		switch {
+		// serialization_failure and deadlock_detected
+		case state == "40001" || state == "40P01":
+			return fmt.Errorf("%w: %v", registry.ErrConflict, err)
+		// insufficient_privilege
+		case state == "42501":
+			return fmt.Errorf("%w: %v", registry.ErrForbidden, err)
+		// query_canceled, e.g. by statement_timeout
+		case state == "57014":
+			return fmt.Errorf("%w: %v", registry.ErrTimeout, err)
+		// connection_exception and cannot_connect_now
+		case strings.HasPrefix(state, "08") || state == "57P03":
+			return fmt.Errorf("%w: %v", registry.ErrUnavailable, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,421 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"k8s.io/apimachinery/pkg/labels"
+
+	regapi "github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// openDB opens a SQLite database in a temporary directory, the directory is removed by cleanup.
+func openDB(t *testing.T) (dsn string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "sql-registry")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+
+	return "file:" + filepath.Join(dir, "registry.db") + "?_busy_timeout=5000", func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestRegistry(t *testing.T, dsn string, opts ...Option) *Registry {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	r, err := newRegistry(db, "sqlite3", opts...)
+	if err != nil {
+		db.Close()
+		t.Fatalf("create new registry failed: %v", err)
+	}
+	r.closeDB = true
+
+	return r
+}
+
+// expectEvent waits for the event of the service.
+func expectEvent(t *testing.T, events <-chan regapi.Event, expected regapi.EventType, service *types.Service) {
+	select {
+	case event := <-events:
+		if event.Type != expected || !reflect.DeepEqual(service, event.Service) {
+			t.Fatalf("the event is %v %v, should be %v %v", event.Type, event.Service, expected, service)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the event %v of %v is not received in time", expected, service)
+	}
+}
+
+func TestRegistery(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	err := registry.Register(context.Background(), service)
+	if err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d, should get 1", len(services))
+	}
+
+	if !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the content of service changed after register")
+	}
+}
+
+func TestListServicesBySelector(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+	defer registry.Close()
+
+	v1 := &types.Service{
+		Name:     "foo",
+		ID:       "foo-1",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1", "zone": "a"},
+	}
+	v2 := &types.Service{
+		Name:     "foo",
+		ID:       "foo-2",
+		Address:  "localhost",
+		Port:     8081,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v2", "zone": "a"},
+	}
+	bar := &types.Service{
+		Name:     "bar",
+		Address:  "localhost",
+		Port:     8082,
+		Endpoint: "/webhook",
+	}
+
+	for _, service := range []*types.Service{v1, v2, bar} {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	services, err := registry.ListServices(context.Background(), regapi.WithName("foo"))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("the number of listed services is %d, should be 2", len(services))
+	}
+
+	selector, err := labels.Parse("version=v2")
+	if err != nil {
+		t.Fatalf("parse selector failed: %v", err)
+	}
+	services, err = registry.ListServices(context.Background(), regapi.WithSelector(selector))
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != 1 || !reflect.DeepEqual(v2, services[0]) {
+		t.Fatalf("the listed services are %v, should be [%v]", services, v2)
+	}
+}
+
+func TestServiceExpire(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn, WithTTL(100*time.Millisecond))
+	defer registry.Close()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after expired", len(services))
+	}
+
+	// Register again, the service comes back.
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err = registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the listed services are %v after registering again, should be [%v]", services, service)
+	}
+}
+
+func TestServiceCleanup(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn, WithTTL(100*time.Millisecond),
+		WithCleanup(50*time.Millisecond), WithPoll(50*time.Millisecond))
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	expectEvent(t, events, regapi.Removed, service)
+
+	// Wait for another cleanup period.
+	time.Sleep(100 * time.Millisecond)
+
+	for _, table := range []string{"services", "metadata"} {
+		var count int
+		if err := registry.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("count the rows of %s failed: %v", table, err)
+		}
+		if count != 0 {
+			t.Fatalf("the number of rows of %s is %d, should be 0 after cleanup", table, count)
+		}
+	}
+}
+
+func TestDeregisterService(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+	defer registry.Close()
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+
+	// Heartbeats of the same service should only be notified once.
+	for i := 0; i < 2; i++ {
+		if err := registry.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	if err := registry.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+	expectEvent(t, events, regapi.Removed, service)
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should be 0 after deregister", len(services))
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	first := newTestRegistry(t, dsn)
+	defer first.Close()
+
+	second := newTestRegistry(t, dsn, WithPoll(50*time.Millisecond))
+	defer second.Close()
+
+	events, err := second.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	service := &types.Service{
+		Name:     "foo",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	// The service registered to one replica is listed and notified by the other.
+	if err := first.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	services, err := second.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != 1 || !reflect.DeepEqual(service, services[0]) {
+		t.Fatalf("the listed services are %v, should be [%v]", services, service)
+	}
+
+	expectEvent(t, events, regapi.Added, service)
+
+	if err := first.Deregister(context.Background(), service); err != nil {
+		t.Fatalf("deregister service failed: %v", err)
+	}
+
+	expectEvent(t, events, regapi.Removed, service)
+}
+
+func TestMigrate(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+	defer registry.Close()
+
+	// Migrating again is a no-op.
+	if err := registry.migrate(context.Background()); err != nil {
+		t.Fatalf("migrate again failed: %v", err)
+	}
+
+	version, err := registry.version(context.Background())
+	if err != nil {
+		t.Fatalf("get the version of schema failed: %v", err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("the version of schema is %d, should be %d", version, len(migrations))
+	}
+
+	// The services survive the restart of registry.
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := registry.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	restarted := newTestRegistry(t, dsn)
+	defer restarted.Close()
+
+	services, err := restarted.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("the number of listed services is %d after restart, should be 1", len(services))
+	}
+}
+
+func TestRebind(t *testing.T) {
+	r := &Registry{postgres: true}
+
+	query := r.rebind(`SELECT id FROM services WHERE heartbeat_at >= ? AND name = ?`)
+	expected := `SELECT id FROM services WHERE heartbeat_at >= $1 AND name = $2`
+	if query != expected {
+		t.Fatalf("the rebound query is %q, should be %q", query, expected)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+
+	events, err := registry.Watch(context.Background())
+	if err != nil {
+		t.Fatalf("watch registry failed: %v", err)
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry failed: %v", err)
+	}
+
+	if _, ok := <-events; ok {
+		t.Fatalf("the channel of events should be closed after the registry is closed")
+	}
+
+	// Close is idempotent.
+	if err := registry.Close(); err != nil {
+		t.Fatalf("close registry again failed: %v", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	dsn, cleanup := openDB(t)
+	defer cleanup()
+
+	registry := newTestRegistry(t, dsn)
+	defer registry.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+
+	if err := registry.Register(ctx, service); err != context.Canceled {
+		t.Fatalf("register service with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+
+	if _, err := registry.ListServices(ctx); err != context.Canceled {
+		t.Fatalf("list services with cancelled context returns %v, should be %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+type EventType string
+
+const (
+	Added   EventType = "ADDED"
+	Updated EventType = "UPDATED"
+	Removed EventType = "REMOVED"
+)
+
+// Event describes a change of the registered services.
+type Event struct {
+	Type    EventType      `json:"type"`
+	Service *types.Service `json:"service"`
+}
+
+// Watcher is implemented by the registries which could notify the changes of services.
+// Only the changes happened after Watch is called are delivered, so consumers should
+// call ListServices to get the initial state.
+//
+// No event is dropped silently. The channel is closed when ctx is done, when the registry is
+// closed, or when the consumer falls behind and its buffer is full. In the last case the
+// consumer has missed events, it should call Watch and then ListServices again to resync, Watch
+// fails if the registry is closed.
+type Watcher interface {
+	Watch(ctx context.Context) (<-chan Event, error)
+}
+
+// The buffer size of the channel of each watcher.
+const watchBuffer = 100
+
+// Broadcaster fans out events to all the watchers, it's shared by the backends to implement Watcher.
+type Broadcaster struct {
+	mtx      sync.Mutex
+	watchers map[chan Event]struct{}
+	// closed when the broadcaster is closed, so the watchers don't wait for their ctx any more.
+	done chan struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		watchers: make(map[chan Event]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (b *Broadcaster) Watch(ctx context.Context) (<-chan Event, error) {
+	ch := make(chan Event, watchBuffer)
+
+	b.mtx.Lock()
+	select {
+	case <-b.done:
+		b.mtx.Unlock()
+		return nil, fmt.Errorf("broadcaster is closed")
+	default:
+	}
+	b.watchers[ch] = struct{}{}
+	b.mtx.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-b.done:
+		}
+
+		b.mtx.Lock()
+		// The channel may have been closed by Close.
+		if _, ok := b.watchers[ch]; ok {
+			delete(b.watchers, ch)
+			close(ch)
+		}
+		b.mtx.Unlock()
+	}()
+
+	return ch, nil
+}
+
+// Close closes the channels of all the watchers, the later Watch fails. It's safe to call it
+// more than once.
+func (b *Broadcaster) Close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	select {
+	case <-b.done:
+		return
+	default:
+	}
+	close(b.done)
+
+	for ch := range b.watchers {
+		delete(b.watchers, ch)
+		close(ch)
+	}
+}
+
+// Notify sends the event to all the watchers. It never blocks, if the channel of a watcher
+// is full, the channel is closed instead of dropping the event, so the watcher knows it has
+// to resync.
+func (b *Broadcaster) Notify(event Event) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for ch := range b.watchers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("the channel of watcher is full on %s event of service %v, close it\n", event.Type, event.Service)
+			delete(b.watchers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/YaoZengzeng/kr/registry"
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// writeError replies the error as the JSON envelope types.Error with the status code.
+func writeError(w http.ResponseWriter, status int, e *types.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Printf("write error response failed: %v\n", err)
+	}
+}
+
+// badRequest replies 400 with the error. The invalid fields of *types.ValidationError are
+// replied too, so the clients could tell which fields to fix. The body over the size limit is
+// replied 413.
+func badRequest(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, &types.Error{Code: types.CodeRequestTooLarge, Message: err.Error()})
+		return
+	}
+
+	e := &types.Error{Code: types.CodeBadRequest, Message: err.Error()}
+	if v, ok := err.(*types.ValidationError); ok {
+		e.Code = types.CodeInvalidService
+		e.Fields = v.Fields
+	}
+
+	writeError(w, http.StatusBadRequest, e)
+}
+
+// backendError replies the error of registry with the status code matching its cause, the
+// cause is kept in the message.
+func backendError(w http.ResponseWriter, action string, err error) {
+	status, e := classify(err)
+	e.Message = fmt.Sprintf("failed to %s: %v", action, err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s\n", e.Message)
+	}
+
+	writeError(w, status, e)
+}
+
+// classify maps the error of registry to the status code and the error code, the backends wrap
+// their errors with the errors of registry.
+func classify(err error) (int, *types.Error) {
+	switch {
+	case errors.Is(err, registry.ErrConflict):
+		return http.StatusConflict, &types.Error{Code: types.CodeConflict, Retryable: true}
+	case errors.Is(err, registry.ErrForbidden):
+		return http.StatusForbidden, &types.Error{Code: types.CodeForbidden}
+	case errors.Is(err, registry.ErrTimeout) || errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, &types.Error{Code: types.CodeTimeout, Retryable: true}
+	case errors.Is(err, registry.ErrUnavailable) || errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, &types.Error{Code: types.CodeUnavailable, Retryable: true}
+	default:
+		return http.StatusInternalServerError, &types.Error{Code: types.CodeInternal}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/YaoZengzeng/kr/auth"
+)
+
+type Option func(*Server) error
+
+// WithAddress sets the address the server listens on, default is ":10812".
+func WithAddress(address string) Option {
+	return func(s *Server) error {
+		s.address = address
+		return nil
+	}
+}
+
+// WithTLS serves HTTPS with the certificate and key in the PEM files instead of plain HTTP.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate of server failed: %v", err)
+		}
+
+		s.tlsConfig().Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithClientCA requires the clients to present a certificate signed by the CAs in the PEM file,
+// it only takes effect together with WithTLS.
+func WithClientCA(caFile string) Option {
+	return func(s *Server) error {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read client CA failed: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate found in client CA %s", caFile)
+		}
+
+		config := s.tlsConfig()
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		return nil
+	}
+}
+
+// WithAuthenticator requires the callers of /register and /deregister to be authenticated by a,
+// use auth.Union to accept more than one kind of credential. Listing and watching the services
+// are not authenticated.
+func WithAuthenticator(a auth.Authenticator) Option {
+	return func(s *Server) error {
+		s.authenticator = a
+		return nil
+	}
+}
+
+// WithAuthorizer rejects the registrations and deregistrations of the services the caller doesn't
+// own with 403, such as an auth.Policy. It requires WithAuthenticator to know the caller.
+func WithAuthorizer(a auth.Authorizer) Option {
+	return func(s *Server) error {
+		s.authorizer = a
+		return nil
+	}
+}
+
+// tlsConfig returns the TLS config of server, it's created on the first call.
+func (s *Server) tlsConfig() *tls.Config {
+	if s.tls == nil {
+		s.tls = &tls.Config{}
+	}
+
+	return s.tls
+}
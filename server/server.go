@@ -1,66 +1,448 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/YaoZengzeng/kr/auth"
 	"github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/types"
 )
 
 type Server struct {
 	Registry registry.Registry
+
+	address string
+	// tls is nil if the server serves plain HTTP.
+	tls *tls.Config
+	// authenticator is nil if the callers are not authenticated.
+	authenticator auth.Authenticator
+	// authorizer is nil if any caller could register or deregister any service.
+	authorizer auth.Authorizer
+
+	mtx sync.Mutex
+	srv *http.Server
+	// done is closed by Shutdown, so the streams of watchers return and the connections could be drained.
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
+// parseService builds the service from the form parameters of the request. The malformed
+// parameters are reported as a *types.ValidationError, the service itself is not validated.
+func parseService(r *http.Request) (*types.Service, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	e := &types.ValidationError{}
+	invalid := func(field, detail string) {
+		e.Fields = append(e.Fields, types.FieldError{Field: field, Detail: detail})
+	}
+
+	// The fields other than metadata are single valued, don't pick one of the duplicates silently.
+	param := func(field string) string {
+		values := r.Form[field]
+		if len(values) > 1 {
+			invalid(field, "must be specified at most once")
+		}
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+
+	service := &types.Service{
+		// Name and ID are optional for compatibility with the old clients.
+		Name:     param("name"),
+		ID:       param("id"),
+		Address:  param("address"),
+		Endpoint: param("endpoint"),
+	}
+
+	if port := param("port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			invalid("port", "must be an integer")
+		}
+		service.Port = n
+	}
+
+	// Each metadata is passed as "key=value".
+	for _, kv := range r.Form["metadata"] {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			invalid("metadata", fmt.Sprintf("%q should be key=value", kv))
+			continue
+		}
+		if _, ok := service.Metadata[parts[0]]; ok {
+			invalid(fmt.Sprintf("metadata[%s]", parts[0]), "must be specified at most once")
+			continue
+		}
+		if service.Metadata == nil {
+			service.Metadata = make(map[string]string)
+		}
+		service.Metadata[parts[0]] = parts[1]
+	}
+
+	if len(e.Fields) != 0 {
+		return nil, e
+	}
+
+	return service, nil
+}
+
+// authenticate returns the name of the caller, empty if the authentication is disabled. It replies
+// 401 and returns false if the caller is not authenticated, or 413 if the body read to verify the
+// signature is too large.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.authenticator == nil {
+		return "", true
+	}
+
+	user, err := s.authenticator.Authenticate(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		badRequest(w, err)
+		return "", false
+	}
+	if err != nil {
+		log.Printf("authenticate %s request from %s failed: %v\n", r.URL.Path, r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, &types.Error{Code: types.CodeUnauthorized, Message: "unauthorized"})
+		return "", false
+	}
+
+	return user, true
+}
+
+// authorize checks whether the user owns the service. It replies 403 and returns false if not,
+// so the service never reaches the registry.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, user string, service *types.Service) bool {
+	if s.authorizer == nil {
+		return true
+	}
+
+	if err := s.authorizer.Authorize(user, service); err != nil {
+		log.Printf("authorize %s request from %s failed: %v\n", r.URL.Path, r.RemoteAddr, err)
+		writeError(w, http.StatusForbidden, &types.Error{Code: types.CodeForbidden, Message: err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// HandleRegister registers the service in the form parameters, it's kept for the old clients.
 func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	paramAddress, ok := r.Form["address"]
+	if _, ok := s.register(w, r, parseService); ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// HandleDeregister deregisters the service in the form parameters, it's kept for the old clients.
+func (s *Server) HandleDeregister(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.deregister(w, r, parseService); ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// register authenticates the caller, then registers the service parsed by parse if it's valid and
+// owned by the caller. It replies the error and returns false if anything fails. The body is
+// limited before authenticating, which may read it to verify the signature.
+func (s *Server) register(w http.ResponseWriter, r *http.Request, parse func(*http.Request) (*types.Service, error)) (*types.Service, bool) {
+	limitBody(w, r)
+	user, ok := s.authenticate(w, r)
 	if !ok {
-		http.Error(w, fmt.Sprintf("failed to parse address of service"), http.StatusBadRequest)
-		return
+		return nil, false
+	}
+
+	service, err := parse(r)
+	if err != nil {
+		badRequest(w, err)
+		return nil, false
+	}
+
+	if err := service.Validate(); err != nil {
+		badRequest(w, err)
+		return nil, false
+	}
+
+	if !s.authorize(w, r, user, service) {
+		return nil, false
+	}
+
+	if err := s.Registry.Register(r.Context(), service); err != nil {
+		backendError(w, "register service", err)
+		return nil, false
 	}
 
-	paramPort, ok := r.Form["port"]
+	return service, true
+}
+
+// deregister is the same as register but deregisters the service. The service is not validated,
+// so the services registered before validation could be deregistered.
+func (s *Server) deregister(w http.ResponseWriter, r *http.Request, parse func(*http.Request) (*types.Service, error)) (*types.Service, bool) {
+	limitBody(w, r)
+	user, ok := s.authenticate(w, r)
 	if !ok {
-		http.Error(w, fmt.Sprintf("failed to parse port of service"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	service, err := parse(r)
+	if err != nil {
+		badRequest(w, err)
+		return nil, false
+	}
+
+	return service, s.remove(w, r, user, service)
+}
+
+// remove deregisters the service if it's owned by the user. It replies the error and returns
+// false if anything fails.
+func (s *Server) remove(w http.ResponseWriter, r *http.Request, user string, service *types.Service) bool {
+	if !s.authorize(w, r, user, service) {
+		return false
+	}
+
+	if err := s.Registry.Deregister(r.Context(), service); err != nil {
+		backendError(w, "deregister service", err)
+		return false
+	}
+
+	return true
+}
+
+// HandleListServices returns the registered services as JSON. The services could be filtered
+// by the optional query parameters "name", "id", "address", "port" and "endpoint", and the metadata
+// of services could be matched by the label selector in query parameter "selector".
+func (s *Server) HandleListServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, &types.Error{Code: types.CodeMethodNotAllowed, Message: fmt.Sprintf("method %s is not allowed", r.Method)})
+		return
+	}
+
+	query := r.URL.Query()
+	port := 0
+	if value := query.Get("port"); value != "" {
+		var err error
+		if port, err = strconv.Atoi(value); err != nil {
+			badRequest(w, fmt.Errorf("failed to convert port number to int"))
+			return
+		}
+	}
+
+	selector, err := labels.Parse(query.Get("selector"))
+	if err != nil {
+		badRequest(w, fmt.Errorf("failed to parse selector: %v", err))
 		return
 	}
-	port, err := strconv.Atoi(paramPort[0])
+
+	services, err := s.Registry.ListServices(r.Context(),
+		registry.WithName(query.Get("name")),
+		registry.WithID(query.Get("id")),
+		registry.WithAddress(query.Get("address")),
+		registry.WithPort(port),
+		registry.WithEndpoint(query.Get("endpoint")),
+		registry.WithSelector(selector),
+	)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to convert port number to int"), http.StatusBadRequest)
+		backendError(w, "list services", err)
 		return
 	}
+	// Reply an empty list rather than null.
+	if services == nil {
+		services = []*types.Service{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(services); err != nil {
+		log.Printf("write services failed: %v\n", err)
+	}
+}
 
-	paramEndpoint, ok := r.Form["endpoint"]
+// HandleWatch streams the changes of services as newline delimited JSON events until
+// the client goes away. The stream ends if the client falls behind, it should list and watch
+// again then.
+func (s *Server) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	watcher, ok := s.Registry.(registry.Watcher)
 	if !ok {
-		http.Error(w, fmt.Sprintf("failed to parse endpoint of service"), http.StatusBadRequest)
+		writeError(w, http.StatusNotImplemented, &types.Error{Code: types.CodeNotImplemented, Message: "registry doesn't support watch"})
 		return
 	}
 
-	err = s.Registry.Register(&types.Service{
-		Address:  paramAddress[0],
-		Port:     port,
-		Endpoint: paramEndpoint[0],
-	})
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, &types.Error{Code: types.CodeInternal, Message: "streaming is not supported"})
+		return
+	}
+
+	events, err := watcher.Watch(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to register service"), http.StatusInternalServerError)
+		backendError(w, "watch services", err)
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				log.Printf("write watch event failed: %v\n", err)
+				return
+			}
+			flusher.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Leader is the leader of the replicas of registry returned by HandleLeader.
+type Leader struct {
+	// Identity of the replica serving the request.
+	Identity string `json:"identity"`
+	// Identity of the leader, empty if it's unknown.
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
 }
 
-func New(registry registry.Registry) (*Server, error) {
-	return &Server{
+// HandleLeader returns the current leader of the replicas of registry.
+func (s *Server) HandleLeader(w http.ResponseWriter, r *http.Request) {
+	elector, ok := s.Registry.(registry.Elector)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, &types.Error{Code: types.CodeNotImplemented, Message: "registry doesn't support leader election"})
+		return
+	}
+
+	leader := &Leader{
+		Identity: elector.Identity(),
+		Leader:   elector.Leader(),
+	}
+	leader.IsLeader = leader.Leader != "" && leader.Leader == leader.Identity
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(leader); err != nil {
+		log.Printf("write leader failed: %v\n", err)
+	}
+}
+
+func New(registry registry.Registry, opts ...Option) (*Server, error) {
+	s := &Server{
 		Registry: registry,
-	}, nil
+		address:  ":10812",
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.tls != nil && len(s.tls.Certificates) == 0 {
+		return nil, fmt.Errorf("the certificate of server is required to verify the clients")
+	}
+
+	if s.authorizer != nil && s.authenticator == nil {
+		return nil, fmt.Errorf("authorization requires the callers to be authenticated")
+	}
+
+	return s, nil
 }
 
+// Handler routes the requests to the handlers of server, so the registry API could be mounted
+// into another HTTP server. It doesn't touch http.DefaultServeMux, more than one server could
+// live in a process.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.HandleRegister)
+	mux.HandleFunc("/deregister", s.HandleDeregister)
+	mux.HandleFunc("/services", s.HandleListServices)
+	mux.HandleFunc("/watch", s.HandleWatch)
+	mux.HandleFunc("/leader", s.HandleLeader)
+
+	mux.HandleFunc(servicesPath, s.HandleServices)
+	mux.HandleFunc(servicesPath+"/", s.HandleServices)
+	mux.HandleFunc("/v1/watch", s.HandleWatch)
+	mux.HandleFunc("/v1/leader", s.HandleLeader)
+
+	return mux
+}
+
+// Run listens on the address of server and serves the requests until Shutdown is called.
 func (s *Server) Run() error {
-	http.HandleFunc("/register", s.HandleRegister)
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serves the requests on the listener until Shutdown is called, it returns nil after
+// a graceful shutdown. The listener is closed when it returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mtx.Lock()
+	select {
+	case <-s.done:
+		s.mtx.Unlock()
+		l.Close()
+		return nil
+	default:
+	}
+	srv := &http.Server{
+		Handler:   s.Handler(),
+		TLSConfig: s.tls,
+	}
+	s.srv = srv
+	s.mtx.Unlock()
 
-	log.Printf("start serving request...")
+	log.Printf("start serving request on %s...\n", l.Addr())
+
+	var err error
+	if s.tls != nil {
+		// The certificates are in the TLS config already.
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting new requests, ends the streams of watchers and waits for the in-flight
+// requests to finish until ctx is done. The registry is not closed, it's owned by the caller.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+	srv := s.srv
+	s.mtx.Unlock()
+
+	if srv == nil {
+		return nil
+	}
 
-	return http.ListenAndServe(":10812", nil)
+	return srv.Shutdown(ctx)
 }
@@ -1,21 +1,42 @@
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/YaoZengzeng/kr/auth"
+	"github.com/YaoZengzeng/kr/registry"
 	"github.com/YaoZengzeng/kr/registry/memory"
+	"github.com/YaoZengzeng/kr/types"
 )
 
 func TestServer(t *testing.T) {
 	registry, err := memory.NewRegistry()
 	if err != nil {
-		return nil, fmt.Errorf("create new registry failed: %v", err)
+		t.Fatalf("create new registry failed: %v", err)
 	}
 
-	s, err := New()
+	s, err := New(registry)
 	if err != nil {
 		t.Fatalf("failed to create server: %v", err)
 	}
@@ -24,9 +45,896 @@ func TestServer(t *testing.T) {
 	defer ts.Close()
 
 	res, err := http.PostForm(ts.URL, url.Values{"address": {"localhost"}, "port": {"8080"}, "endpoint": {"/webhook"}})
+	if err != nil {
+		t.Fatalf("post register request failed: %v", err)
+	}
 	res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		t.Fatalf("register service failed")
 	}
 }
+
+func TestDeregister(t *testing.T) {
+	registry, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(registry)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.HandleRegister)
+	mux.HandleFunc("/deregister", s.HandleDeregister)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	params := url.Values{"address": {"localhost"}, "port": {"8080"}, "endpoint": {"/webhook"}}
+	for _, path := range []string{"/register", "/deregister"} {
+		res, err := http.PostForm(ts.URL+path, params)
+		if err != nil {
+			t.Fatalf("post %s request failed: %v", path, err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("the status code of %s is %d, should be 200", path, res.StatusCode)
+		}
+	}
+
+	services, err := registry.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of listed services is %d, should get 0 after deregisteration", len(services))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWatch))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("get watch request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("the status code of watch is %d, should be 200", res.StatusCode)
+	}
+
+	service := &types.Service{
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+	}
+	if err := r.Register(context.Background(), service); err != nil {
+		t.Fatalf("register service failed: %v", err)
+	}
+
+	event := registry.Event{}
+	if err := json.NewDecoder(res.Body).Decode(&event); err != nil {
+		t.Fatalf("decode watch event failed: %v", err)
+	}
+
+	if event.Type != registry.Added || !reflect.DeepEqual(service, event.Service) {
+		t.Fatalf("the watch event is %v, should be added event of %v", event, service)
+	}
+}
+
+func TestListServices(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	services := []*types.Service{
+		{
+			Address:  "localhost",
+			Port:     8080,
+			Endpoint: "/webhook",
+		},
+		{
+			Name:     "billing-webhook",
+			Address:  "localhost",
+			Port:     8081,
+			Endpoint: "/webhook",
+		},
+	}
+	for _, service := range services {
+		if err := r.Register(context.Background(), service); err != nil {
+			t.Fatalf("register service failed: %v", err)
+		}
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleListServices))
+	defer ts.Close()
+
+	cases := []struct {
+		query    string
+		expected int
+	}{
+		{"", 2},
+		{"?address=localhost", 2},
+		{"?port=8081", 1},
+		{"?name=billing-webhook", 1},
+		{"?endpoint=/message", 0},
+	}
+
+	for _, c := range cases {
+		res, err := http.Get(ts.URL + c.query)
+		if err != nil {
+			t.Fatalf("get services request failed: %v", err)
+		}
+
+		var listed []*types.Service
+		err = json.NewDecoder(res.Body).Decode(&listed)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode services failed: %v", err)
+		}
+
+		if len(listed) != c.expected {
+			t.Fatalf("the number of listed services with query %q is %d, should get %d", c.query, len(listed), c.expected)
+		}
+	}
+}
+
+func TestRegisterWithMetadata(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.HandleRegister)
+	mux.HandleFunc("/services", s.HandleListServices)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.PostForm(ts.URL+"/register", url.Values{
+		"address":  {"localhost"},
+		"port":     {"8080"},
+		"endpoint": {"/webhook"},
+		"metadata": {"version=v1", "zone=cn-north-1a"},
+	})
+	if err != nil {
+		t.Fatalf("post register request failed: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("register service failed")
+	}
+
+	cases := []struct {
+		selector string
+		expected int
+	}{
+		{"version=v1", 1},
+		{"version=v1,zone in (cn-north-1a, cn-north-1b)", 1},
+		{"version!=v1", 0},
+	}
+
+	for _, c := range cases {
+		res, err := http.Get(ts.URL + "/services?" + url.Values{"selector": {c.selector}}.Encode())
+		if err != nil {
+			t.Fatalf("get services request failed: %v", err)
+		}
+
+		var listed []*types.Service
+		err = json.NewDecoder(res.Body).Decode(&listed)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode services failed: %v", err)
+		}
+
+		if len(listed) != c.expected {
+			t.Fatalf("the number of listed services with selector %q is %d, should get %d", c.selector, len(listed), c.expected)
+		}
+	}
+
+	res, err = http.Get(ts.URL + "/services?selector=" + url.QueryEscape("version in (v1"))
+	if err != nil {
+		t.Fatalf("get services request failed: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("the status code of invalid selector is %d, should be 400", res.StatusCode)
+	}
+}
+
+// electedRegistry is a registry whose replica is the leader.
+type electedRegistry struct {
+	*memory.Registry
+	identity string
+}
+
+func (r *electedRegistry) Identity() string {
+	return r.identity
+}
+
+func (r *electedRegistry) Leader() string {
+	return r.identity
+}
+
+func TestLeader(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(&electedRegistry{Registry: r, identity: "replica-0"})
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleLeader))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("get leader request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	leader := &Leader{}
+	if err := json.NewDecoder(res.Body).Decode(leader); err != nil {
+		t.Fatalf("decode leader failed: %v", err)
+	}
+
+	expected := &Leader{Identity: "replica-0", Leader: "replica-0", IsLeader: true}
+	if !reflect.DeepEqual(expected, leader) {
+		t.Fatalf("the leader is %v, should be %v", leader, expected)
+	}
+
+	// The memory registry has no replicas.
+	s.Registry = r
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("get leader request failed: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("the status code of leader is %d, should be 501", res.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/watch")
+	if err != nil {
+		t.Fatalf("get watch request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown server failed: %v", err)
+	}
+
+	// The stream of watch ends after shutdown.
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		t.Fatalf("read watch stream failed: %v", err)
+	}
+
+	// A server which has been shut down doesn't serve again.
+	if err := s.Run(); err != nil {
+		t.Fatalf("run server after shutdown failed: %v", err)
+	}
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 to dir, it's used as the
+// certificate of both server and client, and the CA to verify them.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kr"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate failed: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key failed: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write certificate failed: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key failed: %v", err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kr")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCertificate(t, dir)
+
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r, WithTLS(certFile, keyFile), WithClientCA(certFile))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(l)
+	}()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load certificate failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParse(t, cert.Certificate[0]))
+
+	url := "https://" + l.Addr().String() + "/services"
+
+	// The client without certificate is rejected.
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if res, err := anonymous.Get(url); err == nil {
+		res.Body.Close()
+		t.Fatalf("the client without certificate should be rejected")
+	}
+
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	res, err := authenticated.Get(url)
+	if err != nil {
+		t.Fatalf("list services over mutual TLS failed: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("the status code of list services is %d, should be 200", res.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown server failed: %v", err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatalf("serve failed: %v", err)
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate failed: %v", err)
+	}
+
+	return cert
+}
+
+func TestClientCAWithoutTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kr")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, _ := writeCertificate(t, dir)
+
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	if _, err := New(r, WithClientCA(certFile)); err == nil {
+		t.Fatalf("create server verifying clients without certificate should fail")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r, WithAuthenticator(auth.Tokens{"secret-token": "team-a"}))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	params := url.Values{
+		"address":  {"localhost"},
+		"port":     {"8080"},
+		"endpoint": {"/webhook"},
+	}
+
+	for token, expected := range map[string]int{
+		"":             http.StatusUnauthorized,
+		"wrong-token":  http.StatusUnauthorized,
+		"secret-token": http.StatusOK,
+	} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/register", strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatalf("create register request failed: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("register request failed: %v", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != expected {
+			t.Fatalf("the status code of register with token %q is %d, should be %d", token, res.StatusCode, expected)
+		}
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of registered services is %d, should be 1", len(services))
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	policy := &auth.Policy{
+		Rules: []auth.Rule{
+			{User: "team-a", Names: []string{"payments"}},
+			{User: "team-b", Names: []string{"orders"}},
+		},
+	}
+
+	if _, err := New(r, WithAuthorizer(policy)); err == nil {
+		t.Fatalf("create server with authorizer but no authenticator should fail")
+	}
+
+	s, err := New(r,
+		WithAuthenticator(auth.Tokens{"token-a": "team-a", "token-b": "team-b"}),
+		WithAuthorizer(policy),
+	)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	post := func(path, token string) int {
+		params := url.Values{
+			"name":     {"payments"},
+			"address":  {"localhost"},
+			"port":     {"8080"},
+			"endpoint": {"/webhook"},
+		}
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(params.Encode()))
+		if err != nil {
+			t.Fatalf("create %s request failed: %v", path, err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", path, err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := post("/register", "token-b"); code != http.StatusForbidden {
+		t.Fatalf("the status code of registering service of other team is %d, should be 403", code)
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of registered services is %d, should be 0", len(services))
+	}
+
+	if code := post("/register", "token-a"); code != http.StatusOK {
+		t.Fatalf("the status code of registering own service is %d, should be 200", code)
+	}
+
+	if code := post("/deregister", "token-b"); code != http.StatusForbidden {
+		t.Fatalf("the status code of deregistering service of other team is %d, should be 403", code)
+	}
+
+	services, err = r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 1 {
+		t.Fatalf("the number of registered services is %d, should be 1", len(services))
+	}
+}
+
+func TestRegisterInvalidService(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleRegister))
+	defer ts.Close()
+
+	cases := []struct {
+		params url.Values
+		fields []string
+	}{
+		{url.Values{"address": {"local host"}, "port": {"8080"}, "endpoint": {"/webhook"}}, []string{"address"}},
+		{url.Values{"address": {"localhost"}, "port": {"-1"}, "endpoint": {""}}, []string{"port", "endpoint"}},
+		{url.Values{"address": {"localhost", "10.0.0.1"}, "port": {"8080"}, "endpoint": {"/webhook"}}, []string{"address"}},
+		{url.Values{"address": {"localhost"}, "port": {"http"}, "endpoint": {"/webhook"}}, []string{"port"}},
+		{url.Values{"address": {"localhost"}, "port": {"8080"}, "endpoint": {"/webhook"}, "metadata": {"v=1", "v=2"}}, []string{"metadata[v]"}},
+	}
+
+	for _, c := range cases {
+		res, err := http.PostForm(ts.URL, c.params)
+		if err != nil {
+			t.Fatalf("post register request failed: %v", err)
+		}
+
+		e := &types.Error{}
+		err = json.NewDecoder(res.Body).Decode(e)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode validation error failed: %v", err)
+		}
+
+		if res.StatusCode != http.StatusBadRequest || e.Code != types.CodeInvalidService || e.Retryable {
+			t.Fatalf("registering %v returns %d and %v, should be 400 and non-retryable %s", c.params, res.StatusCode, e, types.CodeInvalidService)
+		}
+
+		var fields []string
+		for _, f := range e.Fields {
+			fields = append(fields, f.Field)
+		}
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Fatalf("the invalid fields of %v are %v, should be %v", c.params, fields, c.fields)
+		}
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of registered services is %d, should be 0", len(services))
+	}
+}
+
+func TestServicesAPI(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	service := &types.Service{
+		Name:     "billing-webhook",
+		Address:  "localhost",
+		Port:     8080,
+		Endpoint: "/webhook",
+		Metadata: map[string]string{"version": "v1"},
+	}
+
+	do := func(method, path, contentType, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("create %s request failed: %v", method, err)
+		}
+		req.Header.Set("Content-Type", contentType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s request failed: %v", method, err)
+		}
+		return res
+	}
+
+	b, err := json.Marshal(service)
+	if err != nil {
+		t.Fatalf("marshal service failed: %v", err)
+	}
+
+	res := do(http.MethodPost, "/v1/services", "application/json", string(b))
+	registered := &types.Service{}
+	err = json.NewDecoder(res.Body).Decode(registered)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("decode registered service failed: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK || !reflect.DeepEqual(service, registered) {
+		t.Fatalf("register returns %d and %v, should be 200 and %v", res.StatusCode, registered, service)
+	}
+
+	res = do(http.MethodGet, "/v1/services", "", "")
+	var listed []*types.Service
+	err = json.NewDecoder(res.Body).Decode(&listed)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("decode services failed: %v", err)
+	}
+
+	if len(listed) != 1 || !reflect.DeepEqual(service, listed[0]) {
+		t.Fatalf("the listed services are %v, should get %v", listed, service)
+	}
+
+	// The service is deregistered by its key, the body is only accepted by /deregister.
+	key := "/v1/services/" + service.Key()
+	for _, c := range []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		expected    int
+	}{
+		{http.MethodPost, "/v1/services", "application/json", `{"address": "localhost", "port": 8080, "endpoint": "/webhook", "weight": 1}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/services", "application/x-www-form-urlencoded", "address=localhost&port=8080&endpoint=%2Fwebhook", http.StatusBadRequest},
+		{http.MethodPut, "/v1/services", "application/json", string(b), http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/v1/services", "application/json", string(b), http.StatusMethodNotAllowed},
+		{http.MethodGet, key, "", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/v1/services/unknown", "", "", http.StatusNotFound},
+		{http.MethodDelete, key, "", "", http.StatusNoContent},
+		{http.MethodDelete, key, "", "", http.StatusNotFound},
+	} {
+		res := do(c.method, c.path, c.contentType, c.body)
+		res.Body.Close()
+
+		if res.StatusCode != c.expected {
+			t.Fatalf("the status code of %s %s %s is %d, should be %d", c.method, c.path, c.body, res.StatusCode, c.expected)
+		}
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of registered services is %d, should be 0 after deregisteration", len(services))
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	r, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	// The signature is verified by reading the body, which must be limited too.
+	secret := []byte("secret")
+	s, err := New(r, WithAuthenticator(auth.HMAC{"team-a": secret}))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// The bodies are valid, only their sizes are over the limit.
+	padding := strings.Repeat("a", maxBodySize)
+	jsonBody := `{"address": "localhost", "port": 8080, "endpoint": "/webhook", "metadata": {"padding": "` + padding + `"}}`
+	formBody := "address=localhost&port=8080&endpoint=/webhook&metadata=padding:" + padding
+
+	cases := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+	}{
+		{http.MethodPost, "/v1/services", "application/json", jsonBody},
+		{http.MethodDelete, "/v1/services/unknown", "application/json", jsonBody},
+		{http.MethodPost, "/register", "application/x-www-form-urlencoded", formBody},
+		{http.MethodPost, "/deregister", "application/x-www-form-urlencoded", formBody},
+	}
+
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, ts.URL+c.path, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatalf("create request failed: %v", err)
+		}
+		req.Header.Set("Content-Type", c.contentType)
+		auth.Sign(req, []byte(c.body), "team-a", secret)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", c.method, c.path, err)
+		}
+
+		e := &types.Error{}
+		err = json.NewDecoder(res.Body).Decode(e)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode error of %s %s failed: %v", c.method, c.path, err)
+		}
+
+		if res.StatusCode != http.StatusRequestEntityTooLarge || e.Code != types.CodeRequestTooLarge {
+			t.Fatalf("the error of too large body of %s %s is %d and %v, should be %d and %s", c.method, c.path, res.StatusCode, e, http.StatusRequestEntityTooLarge, types.CodeRequestTooLarge)
+		}
+	}
+
+	services, err := r.ListServices(context.Background())
+	if err != nil {
+		t.Fatalf("list services failed: %v", err)
+	}
+
+	if len(services) != 0 {
+		t.Fatalf("the number of registered services is %d, should be 0", len(services))
+	}
+}
+
+// failedRegistry is a registry whose registrations always fail with err.
+type failedRegistry struct {
+	*memory.Registry
+	err error
+}
+
+func (r *failedRegistry) Register(ctx context.Context, service *types.Service) error {
+	return r.err
+}
+
+func TestBackendErrors(t *testing.T) {
+	m, err := memory.NewRegistry()
+	if err != nil {
+		t.Fatalf("create new registry failed: %v", err)
+	}
+
+	r := &failedRegistry{Registry: m}
+	s, err := New(r)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	params := url.Values{
+		"address":  {"localhost"},
+		"port":     {"8080"},
+		"endpoint": {"/webhook"},
+	}
+
+	cases := []struct {
+		err       error
+		status    int
+		code      types.ErrorCode
+		retryable bool
+	}{
+		{fmt.Errorf("%w: the object has been modified", registry.ErrConflict), http.StatusConflict, types.CodeConflict, true},
+		{fmt.Errorf("%w: endpoints is forbidden", registry.ErrForbidden), http.StatusForbidden, types.CodeForbidden, false},
+		{fmt.Errorf("%w: etcd is down", registry.ErrUnavailable), http.StatusServiceUnavailable, types.CodeUnavailable, true},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, types.CodeTimeout, true},
+		{fmt.Errorf("disk is full"), http.StatusInternalServerError, types.CodeInternal, false},
+	}
+
+	for _, c := range cases {
+		r.err = c.err
+
+		res, err := http.PostForm(ts.URL+"/register", params)
+		if err != nil {
+			t.Fatalf("post register request failed: %v", err)
+		}
+
+		e := &types.Error{}
+		err = json.NewDecoder(res.Body).Decode(e)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("decode error failed: %v", err)
+		}
+
+		if res.StatusCode != c.status || e.Code != c.code || e.Retryable != c.retryable {
+			t.Fatalf("the error of %v is %d and %v, should be %d, %s and retryable %v", c.err, res.StatusCode, e, c.status, c.code, c.retryable)
+		}
+
+		// The cause is not hidden.
+		if !strings.Contains(e.Message, c.err.Error()) {
+			t.Fatalf("the message %q should contain the cause %q", e.Message, c.err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/YaoZengzeng/kr/types"
+)
+
+// The max size of the JSON body of requests.
+const maxBodySize = 1 << 20
+
+// servicesPath is the path of the versioned JSON API of services, a single service is under it.
+const servicesPath = "/v1/services"
+
+// HandleServices serves the versioned JSON API of services:
+//
+//	GET    /v1/services        lists the services, the query parameters are the same as /services.
+//	POST   /v1/services        registers or heartbeats the service in the body, and returns it.
+//	DELETE /v1/services/{key}  deregisters the service, the key is returned by Service.Key.
+//
+// The identity of a service is its whole content, the key is the hash of it. Deregistering the
+// service in the body is only kept by the legacy /deregister.
+func (s *Server) HandleServices(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != servicesPath {
+		s.handleService(w, r, strings.TrimPrefix(r.URL.Path, servicesPath+"/"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.HandleListServices(w, r)
+	case http.MethodPost:
+		if service, ok := s.register(w, r, decodeService); ok {
+			writeJSON(w, http.StatusOK, service)
+		}
+	default:
+		methodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleService serves the service with the key.
+func (s *Server) handleService(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, r, http.MethodDelete)
+		return
+	}
+
+	limitBody(w, r)
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// The registry is not indexed by key, so the services are listed and hashed.
+	services, err := s.Registry.ListServices(r.Context())
+	if err != nil {
+		backendError(w, "list services", err)
+		return
+	}
+
+	var service *types.Service
+	for _, registered := range services {
+		if registered.Key() == key {
+			service = registered
+			break
+		}
+	}
+	if service == nil {
+		writeError(w, http.StatusNotFound, &types.Error{Code: types.CodeNotFound, Message: fmt.Sprintf("service %s is not found", key)})
+		return
+	}
+
+	if s.remove(w, r, user, service) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, &types.Error{Code: types.CodeMethodNotAllowed, Message: fmt.Sprintf("method %s is not allowed", r.Method)})
+}
+
+// limitBody limits the body of request to maxBodySize, reading beyond it fails with
+// *http.MaxBytesError, which is replied as 413.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+}
+
+// decodeService decodes the JSON service in the body of request, the unknown fields are rejected
+// so the typos don't pass silently.
+func decodeService(r *http.Request) (*types.Service, error) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			return nil, fmt.Errorf("content type %q is not supported, should be application/json", contentType)
+		}
+	}
+
+	if r.Body == nil {
+		return nil, fmt.Errorf("the body of request is empty")
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	service := &types.Service{}
+	if err := decoder.Decode(service); err != nil {
+		return nil, fmt.Errorf("failed to decode service: %w", err)
+	}
+
+	return service, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("write response failed: %v\n", err)
+	}
+}
@@ -0,0 +1,35 @@
+package types
+
+import "fmt"
+
+// ErrorCode is the machine-readable reason of the errors replied by the registry server.
+type ErrorCode string
+
+const (
+	CodeInvalidService   ErrorCode = "InvalidService"
+	CodeBadRequest       ErrorCode = "BadRequest"
+	CodeRequestTooLarge  ErrorCode = "RequestTooLarge"
+	CodeUnauthorized     ErrorCode = "Unauthorized"
+	CodeForbidden        ErrorCode = "Forbidden"
+	CodeNotFound         ErrorCode = "NotFound"
+	CodeMethodNotAllowed ErrorCode = "MethodNotAllowed"
+	CodeConflict         ErrorCode = "Conflict"
+	CodeInternal         ErrorCode = "Internal"
+	CodeNotImplemented   ErrorCode = "NotImplemented"
+	CodeUnavailable      ErrorCode = "Unavailable"
+	CodeTimeout          ErrorCode = "Timeout"
+)
+
+// Error is the JSON envelope of the errors replied by the registry server.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Retryable tells the clients whether the same request may succeed later.
+	Retryable bool `json:"retryable"`
+	// Fields lists the invalid fields if the code is InvalidService.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -1,7 +1,28 @@
 package types
 
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+)
+
 type Service struct {
-	Address		string 	`json:"address"`
-	Port		int    	`json:"port"`
-	Endpoint	string	`json:"endpoint"`
+	// Name groups the instances of the same application, such as "billing-webhook".
+	Name string `json:"name,omitempty"`
+	// ID distinguishes the instances of the same service.
+	ID       string `json:"id,omitempty"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Endpoint string `json:"endpoint"`
+	// Metadata carries the attributes of the instance, such as version, zone, protocol and weight.
+	// It could be matched by label selector when listing services.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Key returns the hash of the whole service, it identifies the service in the API, such as
+// DELETE /v1/services/{key}. A service with any field changed is a different service.
+func (s *Service) Key() string {
+	// The fields are plain strings and numbers, marshaling them never fails.
+	b, _ := json.Marshal(s)
+	return fmt.Sprintf("%x", md5.Sum(b))
 }
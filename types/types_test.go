@@ -0,0 +1,62 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []*Service{
+		{Address: "localhost", Port: 8080, Endpoint: "/webhook"},
+		{Name: "billing-webhook", ID: "0", Address: "10.0.0.1", Port: 443, Endpoint: "/hooks/billing?v=1"},
+		{Address: "fe80::1", Port: 1, Endpoint: "/", Metadata: map[string]string{"version": "v1", "example.com/zone": "a"}},
+		{Address: "billing.default.svc.cluster.local", Port: 65535, Endpoint: "/webhook"},
+		// The values of metadata need not be label values.
+		{Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"description": strings.Repeat("a", 100) + " / beta"}},
+	}
+
+	for _, service := range valid {
+		if err := service.Validate(); err != nil {
+			t.Fatalf("validate service %v failed: %v", service, err)
+		}
+	}
+
+	invalid := map[string]*Service{
+		"name":              {Name: "billing webhook", Address: "localhost", Port: 8080, Endpoint: "/webhook"},
+		"address":           {Address: "local host", Port: 8080, Endpoint: "/webhook"},
+		"port":              {Address: "localhost", Port: -1, Endpoint: "/webhook"},
+		"endpoint":          {Address: "localhost", Port: 8080, Endpoint: "webhook"},
+		"metadata[bad key]": {Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"bad key": "v"}},
+		"metadata[large]":   {Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"large": strings.Repeat("v", MaxMetadataValueLength+1)}},
+		"metadata[zone]":    {Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: map[string]string{"zone": "a\nb"}},
+		"metadata":          {Address: "localhost", Port: 8080, Endpoint: "/webhook", Metadata: largeMetadata()},
+	}
+
+	for field, service := range invalid {
+		err := service.Validate()
+		if err == nil {
+			t.Fatalf("validate service with invalid %s should fail", field)
+		}
+
+		fields := err.(*ValidationError).Fields
+		if len(fields) != 1 || fields[0].Field != field {
+			t.Fatalf("the invalid fields of service are %v, should be %s", fields, field)
+		}
+	}
+
+	// All the invalid fields are reported.
+	err := (&Service{Address: "", Port: 0, Endpoint: ""}).Validate()
+	if err == nil || len(err.(*ValidationError).Fields) != 3 {
+		t.Fatalf("validate empty service returns %v, should report address, port and endpoint", err)
+	}
+}
+
+// largeMetadata returns metadata whose values are all in the limit but their total size is not.
+func largeMetadata() map[string]string {
+	metadata := make(map[string]string)
+	for i := 0; i*MaxMetadataValueLength <= MaxMetadataSize; i++ {
+		metadata[fmt.Sprintf("key%d", i)] = strings.Repeat("v", MaxMetadataValueLength)
+	}
+	return metadata
+}
@@ -0,0 +1,139 @@
+package types
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// MaxMetadataSize is the max total size of the keys and values in metadata. The backends store
+// the services in annotations, which are limited to 256KiB in total per object and may be shared
+// by the instances of a service.
+const MaxMetadataSize = 16 * 1024
+
+// MaxMetadataValueLength is the max size of each value in metadata, so a single value can't take
+// up the whole MaxMetadataSize.
+const MaxMetadataValueLength = 4 * 1024
+
+// FieldError describes why a field of service is invalid.
+type FieldError struct {
+	// Field is the path of field, such as "port" or "metadata[version]".
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// ValidationError lists all the invalid fields of service.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	details := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		details = append(details, fmt.Sprintf("%s: %s", f.Field, f.Detail))
+	}
+
+	return fmt.Sprintf("invalid service: %s", strings.Join(details, "; "))
+}
+
+func (e *ValidationError) add(field string, details ...string) {
+	for _, detail := range details {
+		e.Fields = append(e.Fields, FieldError{Field: field, Detail: detail})
+	}
+}
+
+// Validate checks whether the service could be registered, it returns a *ValidationError
+// listing all the invalid fields. The keys of metadata must be qualified names, each value must
+// be printable UTF-8 of at most MaxMetadataValueLength bytes, and the total size of keys and
+// values must be at most MaxMetadataSize.
+//
+// The values of metadata are not limited to label values. No backend stores them as labels, the
+// Kubernetes backends keep them in annotations or the spec and match the selectors client-side.
+// But a selector could only compare the values which are label values, the others could only be
+// matched by the existence of their keys.
+func (s *Service) Validate() error {
+	e := &ValidationError{}
+
+	// The name is stored as a label value by the Kubernetes backends, empty is allowed for
+	// compatibility with the old clients.
+	if s.Name != "" {
+		e.add("name", validation.IsValidLabelValue(s.Name)...)
+	}
+
+	if len(s.ID) > validation.DNS1123SubdomainMaxLength {
+		e.add("id", validation.MaxLenError(validation.DNS1123SubdomainMaxLength))
+	}
+
+	switch {
+	case s.Address == "":
+		e.add("address", validation.EmptyError())
+	case net.ParseIP(s.Address) != nil:
+	default:
+		e.add("address", validation.IsDNS1123Subdomain(s.Address)...)
+	}
+
+	e.add("port", validation.IsValidPortNum(s.Port)...)
+
+	e.add("endpoint", validateEndpoint(s.Endpoint)...)
+
+	size := 0
+	for k, v := range s.Metadata {
+		field := fmt.Sprintf("metadata[%s]", k)
+		e.add(field, validation.IsQualifiedName(k)...)
+		e.add(field, validateMetadataValue(v)...)
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		e.add("metadata", fmt.Sprintf("must have at most %d bytes in total", MaxMetadataSize))
+	}
+
+	if len(e.Fields) != 0 {
+		return e
+	}
+
+	return nil
+}
+
+// validateMetadataValue checks the value of metadata is printable and not too long, it's put
+// into annotations and HTTP responses as is, never into labels.
+func validateMetadataValue(value string) []string {
+	var errs []string
+	if len(value) > MaxMetadataValueLength {
+		errs = append(errs, validation.MaxLenError(MaxMetadataValueLength))
+	}
+
+	if !utf8.ValidString(value) {
+		errs = append(errs, "must be valid UTF-8")
+	} else if strings.IndexFunc(value, func(r rune) bool { return !unicode.IsPrint(r) && r != ' ' }) >= 0 {
+		errs = append(errs, "must not contain control characters")
+	}
+
+	return errs
+}
+
+// validateEndpoint checks the endpoint is an absolute path which could be appended to the
+// address and port of service, the query is allowed.
+func validateEndpoint(endpoint string) []string {
+	if endpoint == "" {
+		return []string{validation.EmptyError()}
+	}
+
+	if !strings.HasPrefix(endpoint, "/") {
+		return []string{"must be an absolute path starting with '/'"}
+	}
+
+	if strings.ContainsAny(endpoint, " \t\r\n#") {
+		return []string{"must not contain whitespaces or fragment"}
+	}
+
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return []string{fmt.Sprintf("must be a valid path: %v", err)}
+	}
+
+	return nil
+}